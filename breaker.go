@@ -0,0 +1,118 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting CouchDB while it is considered down.
+var ErrCircuitOpen = errors.New("db: circuit breaker open")
+
+// A BreakerPolicy tells when the circuit breaker of a CouchDB store opens.
+// The zero value disables the circuit breaker.
+type BreakerPolicy struct {
+	Threshold int           // number of consecutive failures opening the circuit
+	Cooldown  time.Duration // time before a trial request is let through, 30s if zero
+}
+
+// A BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // requests go through
+	BreakerOpen                         // requests fail fast with ErrCircuitOpen
+	BreakerHalfOpen                     // a trial request decides whether to close the circuit
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// A breaker is a circuit breaker counting consecutive failures of requests.
+type breaker struct {
+	policy BreakerPolicy
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	opened   time.Time
+}
+
+// State returns the current state of the breaker.
+func (b *breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.opened) >= b.cooldown() {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow returns ErrCircuitOpen if a request must not be sent.
+// Once the cooldown is over, a single trial request is allowed.
+func (b *breaker) allow() error {
+	if b.policy.Threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.opened) < b.cooldown() {
+			return ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+	case BreakerHalfOpen:
+		return ErrCircuitOpen // trial in progress
+	}
+	return nil
+}
+
+// record records the outcome of a request let through by allow.
+func (b *breaker) record(ok bool) {
+	if b.policy.Threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.policy.Threshold {
+		b.state = BreakerOpen
+		b.opened = time.Now()
+	}
+}
+
+// release gives up a request let through by allow without an outcome, such as a cancelled one.
+// A trial request being given up, the circuit is open again and another trial can be let through.
+func (b *breaker) release() {
+	if b.policy.Threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.state = BreakerOpen
+	}
+}
+
+func (b *breaker) cooldown() time.Duration {
+	if b.policy.Cooldown <= 0 {
+		return 30 * time.Second
+	}
+	return b.policy.Cooldown
+}
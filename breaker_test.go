@@ -0,0 +1,60 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{policy: BreakerPolicy{Threshold: 2, Cooldown: time.Millisecond}}
+	for i := 0; i < 2; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatal(err)
+		}
+		b.record(false)
+	}
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, want ErrCircuitOpen", err)
+	}
+
+	// A released trial lets another one through
+	time.Sleep(2 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v during the trial, want ErrCircuitOpen", err)
+	}
+	b.release()
+	if s := b.State(); s != BreakerHalfOpen {
+		t.Fatalf("got %v after the trial was released, want half-open", s)
+	}
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed trial opens the circuit again, a successful one closes it
+	b.record(false)
+	if s := b.State(); s != BreakerOpen {
+		t.Fatalf("got %v after a failed trial, want open", s)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.record(true)
+	if s := b.State(); s != BreakerClosed {
+		t.Fatalf("got %v after a successful trial, want closed", s)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	var b breaker
+	for i := 0; i < 10; i++ {
+		b.record(false)
+		if err := b.allow(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// cacheTypes are the types of the documents kept by the read cache.
+var cacheTypes = map[string]bool{"user": true, "circle": true, "event": true}
+
+// CacheStats counts the activity of the read cache of a DB (see WithCache).
+type CacheStats struct {
+	Hits          int64 // documents served from the cache, possibly after revalidation
+	Misses        int64 // documents fetched in full from the store
+	Revalidations int64 // conditional requests checking the revision of an entry
+	Invalidations int64 // entries dropped after a write or a change
+	Evictions     int64 // entries dropped to make room for others
+	Entries       int   // current number of entries
+}
+
+// A cache is a Store keeping the latest user, circle and event documents read from another store,
+// up to a number of entries, the least recently used being evicted first.
+//
+// Entries are revalidated by revision before being served, with If-None-Match requests for CouchDB,
+// unless the cache follows the changes feed of the store (see follow), which then invalidates them.
+// The documents written through the cache, or seen in the changes it returns, are dropped.
+type cache struct {
+	store Store
+	size  int
+
+	mu        sync.Mutex
+	entries   map[string]*list.Element // of *cacheEntry
+	lru       *list.List               // most recently used first
+	epoch     int                      // incremented when following starts or stops
+	followers int                      // running calls to follow
+	dropped   uint64                   // incremented by each invalidation
+	stats     CacheStats
+}
+
+// A cacheEntry is a document of the cache.
+type cacheEntry struct {
+	id    string
+	rev   string
+	doc   json.RawMessage
+	epoch int // epoch in which the document was known to be current, -1 if unknown
+}
+
+// A cacheMark is the state of the cache when a request starts.
+// The documents returned by the request may only be trusted
+// if the cache was neither invalidated nor started or stopped following meanwhile.
+type cacheMark struct {
+	epoch   int
+	dropped uint64
+}
+
+// newCache returns a cache of at most size documents of s.
+func newCache(s Store, size int) *cache {
+	return &cache{
+		store:   s,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Stats returns the statistics of the cache.
+func (c *cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = c.lru.Len()
+	return s
+}
+
+// mark returns the current state of the cache. The caller must hold the lock.
+func (c *cache) mark() cacheMark {
+	return cacheMark{c.epoch, c.dropped}
+}
+
+// lookup returns the entry of a document, if any, and whether it can be served as is.
+// The caller must hold the lock.
+func (c *cache) lookup(id string) (cacheEntry, bool, bool) {
+	el, ok := c.entries[id]
+	if !ok {
+		return cacheEntry{}, false, false
+	}
+	c.lru.MoveToFront(el)
+	e := *el.Value.(*cacheEntry)
+	return e, true, c.followers > 0 && e.epoch == c.epoch
+}
+
+// put adds or replaces the entry of a document given as raw JSON, fetched since m.
+// It reports whether the document is of a cached type.
+func (c *cache) put(doc json.RawMessage, m cacheMark) bool {
+	var meta struct {
+		Id   string `json:"_id"`
+		Rev  string `json:"_rev"`
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(doc, &meta) != nil || !cacheTypes[meta.Type] || meta.Id == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &cacheEntry{id: meta.Id, rev: meta.Rev, doc: doc, epoch: m.epoch}
+	if m != c.mark() {
+		e.epoch = -1 // may have changed meanwhile: revalidate before use
+	}
+	if el, ok := c.entries[meta.Id]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return true
+	}
+	c.entries[meta.Id] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).id)
+		c.stats.Evictions++
+	}
+	return true
+}
+
+// invalidate drops the entries of documents.
+func (c *cache) invalidate(ids ...string) {
+	if len(ids) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropped++
+	for _, id := range ids {
+		if el, ok := c.entries[id]; ok {
+			c.lru.Remove(el)
+			delete(c.entries, id)
+			c.stats.Invalidations++
+		}
+	}
+}
+
+// count increments a statistic.
+func (c *cache) count(n *int64) {
+	c.mu.Lock()
+	*n++
+	c.mu.Unlock()
+}
+
+// Get decodes the document with the given id into doc, from the cache if possible.
+func (c *cache) Get(ctx context.Context, id string, doc interface{}) error {
+	raw, err := c.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	return stack(json.Unmarshal(raw, doc), "cache: error decoding %q", id)
+}
+
+// get returns the document with the given id as raw JSON.
+func (c *cache) get(ctx context.Context, id string) (json.RawMessage, error) {
+	c.mu.Lock()
+	m := c.mark()
+	e, ok, fresh := c.lookup(id)
+	if fresh {
+		c.stats.Hits++
+	}
+	c.mu.Unlock()
+	if fresh {
+		return e.doc, nil
+	}
+
+	var raw json.RawMessage
+	if cg, can := c.store.(interface {
+		getIfNoneMatch(ctx context.Context, id, rev string, doc interface{}) (bool, error)
+	}); ok && can {
+		c.count(&c.stats.Revalidations)
+		modified, err := cg.getIfNoneMatch(ctx, id, e.rev, &raw)
+		if err != nil {
+			return nil, err
+		}
+		if !modified {
+			c.put(e.doc, m)
+			c.count(&c.stats.Hits)
+			return e.doc, nil
+		}
+	} else if err := c.store.Get(ctx, id, &raw); err != nil {
+		return nil, err
+	}
+	if c.put(raw, m) {
+		if ok && docRev(raw) == e.rev {
+			c.count(&c.stats.Hits) // revalidated without conditional request
+		} else {
+			c.count(&c.stats.Misses)
+		}
+	}
+	return raw, nil
+}
+
+// getAll returns the documents with the given ids as raw JSON, in order,
+// from the cache if possible and otherwise fetched at once. Missing documents are null.
+func (c *cache) getAll(ctx context.Context, ids []string) ([]json.RawMessage, error) {
+	docs := make([]json.RawMessage, len(ids))
+	index := make(map[string][]int) // positions of the documents to fetch
+	var missing []string
+	c.mu.Lock()
+	m := c.mark()
+	for i, id := range ids {
+		if e, _, fresh := c.lookup(id); fresh {
+			docs[i] = e.doc
+			c.stats.Hits++
+			continue
+		}
+		if _, ok := index[id]; !ok {
+			missing = append(missing, id)
+		}
+		index[id] = append(index[id], i)
+	}
+	c.mu.Unlock()
+	if len(missing) == 0 {
+		return docs, nil
+	}
+
+	var fetched []json.RawMessage
+	if bg, ok := c.store.(interface {
+		getAll(ctx context.Context, ids []string) ([]json.RawMessage, error)
+	}); ok {
+		var err error
+		if fetched, err = bg.getAll(ctx, missing); err != nil {
+			return nil, err
+		}
+	} else {
+		fetched = make([]json.RawMessage, len(missing))
+		for i, id := range missing {
+			if err := c.store.Get(ctx, id, &fetched[i]); errors.Is(err, ErrNotFound) {
+				fetched[i] = json.RawMessage("null")
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i, id := range missing {
+		if c.put(fetched[i], m) {
+			c.count(&c.stats.Misses)
+		}
+		for _, j := range index[id] {
+			docs[j] = fetched[i]
+		}
+	}
+	return docs, nil
+}
+
+// Query decodes the rows of a view matching key into out.
+// While the cache follows the changes feed, the documents of the rows come from the cache
+// and those missing are fetched with a single request; otherwise the cache is filled
+// with the documents included in the rows.
+func (c *cache) Query(ctx context.Context, view View, key string, includeDocs bool, out interface{}) error {
+	if !includeDocs {
+		return c.store.Query(ctx, view, key, false, out)
+	}
+	c.mu.Lock()
+	m, following := c.mark(), c.followers > 0
+	c.mu.Unlock()
+
+	if !following {
+		var raw json.RawMessage
+		if err := c.store.Query(ctx, view, key, true, &raw); err != nil {
+			return err
+		}
+		var v struct {
+			Rows []struct{ Doc json.RawMessage }
+		}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return stack(err, "cache: error decoding %s view", view)
+		}
+		for _, r := range v.Rows {
+			if c.put(r.Doc, m) {
+				c.count(&c.stats.Misses)
+			}
+		}
+		return stack(json.Unmarshal(raw, out), "cache: error decoding %s view", view)
+	}
+
+	var v struct {
+		Rows []map[string]interface{} `json:"rows"`
+	}
+	if err := c.store.Query(ctx, view, key, false, &v); err != nil {
+		return err
+	}
+	ids := make([]string, len(v.Rows))
+	for i, r := range v.Rows {
+		ids[i] = rowDoc(r)
+	}
+	docs, err := c.getAll(ctx, ids)
+	if err != nil {
+		return stack(err, "cache: cannot get documents of %s view", view)
+	}
+	for i, r := range v.Rows {
+		r["doc"] = docs[i]
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return stack(err, "cache: error encoding %s view", view)
+	}
+	return stack(json.Unmarshal(b, out), "cache: error decoding %s view", view)
+}
+
+// rowDoc returns the id of the document included in a view row:
+// the one referenced by the value's _id if any, or the emitting document.
+func rowDoc(r map[string]interface{}) string {
+	if v, ok := r["value"].(map[string]interface{}); ok {
+		if id, ok := v["_id"].(string); ok {
+			return id
+		}
+	}
+	id, _ := r["id"].(string)
+	return id
+}
+
+// docRev returns the revision of a document given as raw JSON.
+func docRev(doc json.RawMessage) string {
+	var v struct {
+		Rev string `json:"_rev"`
+	}
+	json.Unmarshal(doc, &v)
+	return v.Rev
+}
+
+// Create stores a new document and returns its generated id and revision.
+func (c *cache) Create(ctx context.Context, doc interface{}) (string, string, error) {
+	id, rev, err := c.store.Create(ctx, doc)
+	c.invalidate(id)
+	return id, rev, err
+}
+
+// CreateAll stores new documents and returns the outcome for each of them, in order.
+func (c *cache) CreateAll(ctx context.Context, docs []interface{}) ([]BulkResult, error) {
+	res, err := c.store.CreateAll(ctx, docs)
+	ids := make([]string, len(res))
+	for i, r := range res {
+		ids[i] = r.Id
+	}
+	c.invalidate(ids...)
+	return res, err
+}
+
+// Put creates or updates the document with the given id and returns its new revision.
+func (c *cache) Put(ctx context.Context, id string, doc interface{}) (string, error) {
+	rev, err := c.store.Put(ctx, id, doc)
+	c.invalidate(id)
+	return rev, err
+}
+
+// Delete removes the document with the given id and revision.
+func (c *cache) Delete(ctx context.Context, id, rev string) error {
+	err := c.store.Delete(ctx, id, rev)
+	c.invalidate(id)
+	return err
+}
+
+// Infos returns the metadata of documents, in the order of ids.
+func (c *cache) Infos(ctx context.Context, ids []string) ([]DocInfo, error) {
+	return c.store.Infos(ctx, ids)
+}
+
+// Scan calls fn with every document whose id sorts after the given one, in id order.
+func (c *cache) Scan(ctx context.Context, after string, fn func(doc map[string]interface{}) error) error {
+	return c.store.Scan(ctx, after, fn)
+}
+
+// Changes returns the changes of the store, dropping the documents that changed.
+func (c *cache) Changes(ctx context.Context, since string, wait bool) ([]Change, string, error) {
+	f, ok := c.store.(Feed)
+	if !ok {
+		return nil, "", errors.New("cache: store has no changes feed")
+	}
+	changes, next, err := f.Changes(ctx, since, wait)
+	for _, ch := range changes {
+		c.invalidate(ch.Id)
+	}
+	return changes, next, err
+}
+
+// BreakerState returns the state of the circuit breaker of the store, if any.
+func (c *cache) BreakerState() BreakerState {
+	if b, ok := c.store.(interface{ BreakerState() BreakerState }); ok {
+		return b.BreakerState()
+	}
+	return BreakerClosed
+}
+
+// follow invalidates the entries of the documents changing in the store until ctx is done
+// or the changes feed fails. Meanwhile entries are served without revalidation.
+func (c *cache) follow(ctx context.Context) error {
+	f, ok := c.store.(Feed)
+	if !ok {
+		return errors.New("cache: store has no changes feed")
+	}
+	_, since, err := f.Changes(ctx, "now", false)
+	if err != nil {
+		return stack(err, "cache: cannot follow changes")
+	}
+	c.mu.Lock()
+	c.epoch++
+	c.followers++
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.epoch++
+		c.followers--
+		c.mu.Unlock()
+	}()
+	for {
+		changes, next, err := f.Changes(ctx, since, true)
+		if err != nil {
+			return stack(err, "cache: cannot follow changes")
+		}
+		ids := make([]string, len(changes))
+		for i, ch := range changes {
+			ids[i] = ch.Id
+		}
+		c.invalidate(ids...)
+		since = next
+	}
+}
@@ -0,0 +1,142 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// cachedName returns the name of a user read through a cache.
+func cachedName(t *testing.T, c *cache, id string) string {
+	t.Helper()
+	var u user
+	if err := c.Get(context.Background(), id, &u); err != nil {
+		t.Fatal(err)
+	}
+	return u.Name
+}
+
+// rename changes the name of a user directly in a store.
+func rename(t *testing.T, s Store, id, name string) {
+	t.Helper()
+	ctx := context.Background()
+	var u user
+	if err := s.Get(ctx, id, &u); err != nil {
+		t.Fatal(err)
+	}
+	u.Name = name
+	if _, err := s.Put(ctx, id, &u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	_, m := fixtureDB(t)
+	c := newCache(m, 2)
+	cachedName(t, c, "u0sim")
+	cachedName(t, c, "u0amin")
+	cachedName(t, c, "u0sim") // most recently used
+	cachedName(t, c, "u0kus") // evicts u0amin
+	if s := c.Stats(); s.Entries != 2 || s.Evictions != 1 || s.Misses != 3 || s.Hits != 1 {
+		t.Fatalf("got %+v, want 2 entries, 1 eviction, 3 misses and 1 hit", s)
+	}
+	cachedName(t, c, "u0sim")
+	cachedName(t, c, "u0amin")
+	if s := c.Stats(); s.Misses != 4 || s.Hits != 2 {
+		t.Errorf("got %+v, want u0sim kept and u0amin evicted", s)
+	}
+
+	// Other types of documents are not cached
+	var p participant
+	if err := c.Get(context.Background(), "p0sim1movie", &p); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.Misses != 4 {
+		t.Errorf("got %+v, want participants not cached", s)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	_, m := fixtureDB(t)
+	c := newCache(m, 10)
+	ctx := context.Background()
+
+	// Writes through the cache drop the documents written
+	cachedName(t, c, "u0sim")
+	rename(t, c, "u0sim", "Simon L.")
+	if s := c.Stats(); s.Invalidations != 1 || s.Entries != 0 {
+		t.Fatalf("got %+v, want the written document dropped", s)
+	}
+	if name := cachedName(t, c, "u0sim"); name != "Simon L." {
+		t.Errorf("got name %q after a write, want Simon L.", name)
+	}
+
+	// So do the changes it returns
+	_, since, err := c.Changes(ctx, "now", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachedName(t, c, "u0amin")
+	rename(t, m, "u0amin", "Amin B.")
+	if _, _, err := c.Changes(ctx, since, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.entries["u0amin"]; ok {
+		t.Error("changed document still cached")
+	}
+	if name := cachedName(t, c, "u0amin"); name != "Amin B." {
+		t.Errorf("got name %q after a change, want Amin B.", name)
+	}
+}
+
+func TestCacheFollow(t *testing.T) {
+	_, m := fixtureDB(t)
+	g := &countGets{Memory: m}
+	db := NewWithStore(g, WithCache(10))
+	c := db.store.(*cache)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- db.FollowChanges(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		following := c.followers > 0
+		c.mu.Unlock()
+		if following {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not following")
+		}
+	}
+
+	// Entries are served as is while following, until the feed drops them
+	cachedName(t, c, "u0sim")
+	cachedName(t, c, "u0sim")
+	if s := c.Stats(); s.Hits != 1 || s.Misses != 1 || g.n != 1 {
+		t.Fatalf("got %+v and %d gets, want 1 hit, 1 miss and 1 get", s, g.n)
+	}
+	rename(t, m, "u0sim", "Simon L.")
+	for deadline := time.Now().Add(time.Second); cachedName(t, c, "u0sim") != "Simon L."; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("change not followed")
+		}
+	}
+	if s := c.Stats(); s.Invalidations != 1 {
+		t.Errorf("got %+v, want 1 invalidation", s)
+	}
+}
+
+// countGets is a Memory store counting the documents read with Get.
+type countGets struct {
+	*Memory
+	n int
+}
+
+func (g *countGets) Get(ctx context.Context, id string, doc interface{}) error {
+	g.n++
+	return g.Memory.Get(ctx, id, doc)
+}
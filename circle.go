@@ -1,14 +1,12 @@
 package db
 
 import (
-	"fmt"
-	"net/http"
+	"context"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/fiam/gounidecode/unidecode"
-	"github.com/simleb/errors"
 )
 
 // A Circle is a proxy for a full circle document in the database.
@@ -52,37 +50,41 @@ type member struct {
 // The slug has to be unique.
 // If left blank, a slug will tentatively be derived from the name.
 func (db *DB) NewCircle(name, slug, creator string) (string, error) {
+	return db.NewCircleContext(context.Background(), name, slug, creator)
+}
+
+// NewCircleContext is like NewCircle but passes ctx down to every database request.
+func (db *DB) NewCircleContext(ctx context.Context, name, slug, creator string) (_ string, err error) {
+	ctx, end := db.context(ctx, "new circle")
+	defer end(&err)
+
 	// Check for empty fields
 	if name == "" {
-		return "", fmt.Errorf("new circle: name is missing")
+		return "", stack(invalid("name", "is missing"), "new circle")
 	}
 	if slug == "" {
 		slug = Slugify(slug)
 	}
 	if creator == "" {
-		return "", fmt.Errorf("new circle: initial member is missing")
+		return "", stack(invalid("creator", "is missing"), "new circle")
 	}
 
 	// Check if slug is unique
 	var v struct{ Rows []struct{ Value string } }
-	s, err := db.get(db.view("slug", slug, false), &v)
-	if err != nil {
-		return "", err
-	}
-	if s != http.StatusOK {
-		return "", fmt.Errorf("new circle: database error")
+	if err := db.store.Query(ctx, ViewSlug, slug, false, &v); err != nil {
+		return "", stack(err, "new circle: database error")
 	}
 	if len(v.Rows) > 0 {
-		return "", fmt.Errorf("new circle: slug is not unique")
+		return "", stack(ErrSlugTaken, "new circle")
 	}
 
 	// Check if creator exists
-	rev, err := db.rev(creator)
+	infos, err := db.store.Infos(ctx, []string{creator})
 	if err != nil {
-		return "", errors.Stack(err, "new circle: database error")
+		return "", stack(err, "new circle: database error")
 	}
-	if rev == "" {
-		return "", fmt.Errorf("new circle: initial member does not exist")
+	if !infos[0].Exists() || infos[0].Type != "user" {
+		return "", stack(ErrNotFound, "new circle: initial member %q", creator)
 	}
 
 	// Create circle document in database
@@ -91,42 +93,40 @@ func (db *DB) NewCircle(name, slug, creator string) (string, error) {
 		Name: name,
 		Slug: slug,
 	}
-	var r struct{ Id string }
-	s, err = db.post("", &c, &r)
+	u := db.begin(ctx)
+	id, err := u.create(&c)
 	if err != nil {
-		return "", err
-	}
-	if s != http.StatusCreated {
-		return "", fmt.Errorf("new circle: database error")
+		return "", stack(err, "new circle: database error")
 	}
 
 	// Create member document in database
 	m := member{
 		Type:   "member",
 		User:   creator,
-		Circle: r.Id,
+		Circle: id,
 		Rights: []string{"post", "invite", "admin"},
 		Date:   time.Now(),
 	}
-	s, err = db.post("", &m, nil)
-	if err != nil {
-		return r.Id, err
-	}
-	if s != http.StatusCreated {
-		return r.Id, fmt.Errorf("new circle: database error")
+	if _, err = u.create(&m); err != nil {
+		return "", u.abort(stack(err, "new circle: database error"))
 	}
 
-	return r.Id, nil
+	return id, nil
 }
 
+// GetCircles returns the circles a user is a member of.
 func (db *DB) GetCircles(userId string) ([]Circle, error) {
+	return db.GetCirclesContext(context.Background(), userId)
+}
+
+// GetCirclesContext is like GetCircles but passes ctx down to every database request.
+func (db *DB) GetCirclesContext(ctx context.Context, userId string) (_ []Circle, err error) {
+	ctx, end := db.context(ctx, "get circles")
+	defer end(&err)
+
 	var v struct{ Rows []struct{ Doc circle } }
-	s, err := db.get(db.view("circles", userId, true), &v)
-	if err != nil {
-		return nil, errors.Stack(err, "get circles: error querying circles view")
-	}
-	if s != http.StatusOK {
-		return nil, fmt.Errorf("get circles: database error")
+	if err := db.store.Query(ctx, ViewCircles, userId, true, &v); err != nil {
+		return nil, stack(err, "get circles: error querying circles view")
 	}
 	c := make([]Circle, len(v.Rows))
 	for i, r := range v.Rows {
@@ -137,19 +137,35 @@ func (db *DB) GetCircles(userId string) ([]Circle, error) {
 	return c, nil
 }
 
+// SendInvitation makes the user owning an email, primary or not, a member of a circle.
+// With WithVerifiedEmails, the email must be verified.
 func (db *DB) SendInvitation(circleId, email string) error {
+	return db.SendInvitationContext(context.Background(), circleId, email)
+}
+
+// SendInvitationContext is like SendInvitation but passes ctx down to every database request.
+func (db *DB) SendInvitationContext(ctx context.Context, circleId, email string) (err error) {
+	ctx, end := db.context(ctx, "send invitation")
+	defer end(&err)
+
 	email = normalizeEmail(email)
 	var v struct{ Rows []struct{ Doc user } }
-	s, err := db.get(db.view("email", email, true), &v)
-	if err != nil {
-		return errors.Stack(err, "send invitation: error querying email view")
+	if err := db.store.Query(ctx, ViewEmail, email, true, &v); err != nil {
+		return stack(err, "send invitation: error querying email view")
 	}
-	if s != http.StatusOK {
-		return fmt.Errorf("send invitation: get email view got status %d", s)
+	if len(v.Rows) < 1 || db.verifiedOnly && !v.Rows[0].Doc.verified(email) {
+		return stack(ErrNotFound, "send invitation: email %q", email)
 	}
-	if len(v.Rows) < 1 {
-		return fmt.Errorf("send invitation: email not found")
+
+	// Check that the circle exists
+	infos, err := db.store.Infos(ctx, []string{circleId})
+	if err != nil {
+		return stack(err, "send invitation: database error")
+	}
+	if !infos[0].Exists() || infos[0].Type != "circle" {
+		return stack(ErrNotFound, "send invitation: circle %q", circleId)
 	}
+
 	m := member{
 		Type:   "member",
 		User:   v.Rows[0].Doc.Id,
@@ -157,12 +173,9 @@ func (db *DB) SendInvitation(circleId, email string) error {
 		Rights: []string{"post", "invite", "admin"},
 		Date:   time.Now(),
 	}
-	s, err = db.post("", &m, nil)
-	if err != nil {
-		return errors.Stack(err, "send invitation: database error")
-	}
-	if s != http.StatusCreated {
-		return fmt.Errorf("send invitation: post member got status %d", s)
+	u := db.begin(ctx)
+	if _, err := u.create(&m); err != nil {
+		return u.abort(stack(err, "send invitation: database error"))
 	}
 	return nil
 }
@@ -0,0 +1,639 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CouchDB is a Store backed by a CouchDB database over HTTP.
+// It expects the toople design document (see couchdb/views) to be deployed.
+type CouchDB struct {
+	url      string // URL of the database
+	server   string // URL of the server, ending with "/"
+	host     string // host and port of the server, for error messages
+	username string
+	password string
+	client   *http.Client
+	tracer   trace.Tracer
+	retry    RetryPolicy
+	breaker  breaker
+
+	mu      sync.Mutex    // protects the session state below
+	timeout time.Duration // lifetime of a session unless told by the server
+	session int           // incremented on each authentication
+	renewAt time.Time     // when the session should be renewed
+}
+
+// NewCouchDB connects to a CouchDB database over plain HTTP and checks read/write access.
+func NewCouchDB(host, port, username, password, dbname string) (*CouchDB, error) {
+	return DialCouchDB(CouchDBConfig{
+		URL:      fmt.Sprintf("http://%s:%s/%s", host, port, dbname),
+		Username: username,
+		Password: password,
+	})
+}
+
+// DialCouchDB connects to the CouchDB database described by c and checks read/write access.
+func DialCouchDB(c CouchDBConfig) (*CouchDB, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, stack(err, "db: bad URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("db: %s: unsupported scheme %q", u.Host, u.Scheme)
+	}
+
+	// Split path into prefix and database name
+	p := strings.Trim(u.Path, "/")
+	prefix, dbname := "", p
+	if n := strings.LastIndex(p, "/"); n != -1 {
+		prefix, dbname = p[:n+1], p[n+1:]
+	}
+	if dbname == "" {
+		return nil, fmt.Errorf("db: %s: database name is missing", u.Host)
+	}
+
+	// Credentials in the URL are used unless given explicitly
+	username, password := c.Username, c.Password
+	if u.User != nil && username == "" {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	rt := c.Transport
+	if rt == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		if c.Proxy != nil {
+			t.Proxy = c.Proxy
+		}
+		if u.Scheme == "https" {
+			t.TLSClientConfig = &tls.Config{
+				RootCAs:      c.RootCAs,
+				Certificates: c.Certificates,
+				ServerName:   u.Hostname(),
+			}
+		}
+		if c.MaxIdleConns > 0 {
+			t.MaxIdleConns = c.MaxIdleConns
+			t.MaxIdleConnsPerHost = c.MaxIdleConns
+		}
+		t.MaxConnsPerHost = c.MaxConns
+		rt = t
+	}
+	if c.UserAgent == "" {
+		c.UserAgent = defaultUserAgent
+	}
+	if c.Logger != nil {
+		rt = &logTransport{rt, c.Logger, strings.TrimSuffix(u.Path, "/")}
+	}
+	if c.Metrics != nil {
+		rt = &metricsTransport{rt, c.Metrics, strings.TrimSuffix(u.Path, "/")}
+	}
+	rt = &userAgent{rt, c.UserAgent}
+	jar, _ := cookiejar.New(nil) // err is always nil
+	server := fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, prefix)
+	db := &CouchDB{
+		url:      server + dbname,
+		server:   server,
+		host:     u.Host,
+		username: username,
+		password: password,
+		client:   &http.Client{Jar: jar, Transport: rt, Timeout: c.RequestTimeout},
+		tracer:   tracer(c.TracerProvider),
+		timeout:  c.SessionTimeout,
+		retry:    c.Retry,
+		breaker:  breaker{policy: c.Breaker},
+	}
+	if db.timeout <= 0 {
+		db.timeout = defaultSessionTimeout
+	}
+	if c.Lazy {
+		return db, nil // authenticate on first request
+	}
+	if err := db.check(); err != nil {
+		return nil, err
+	}
+	if err := db.authenticate(context.Background()); err != nil {
+		return nil, err
+	}
+	if _, err := syncDesign(context.Background(), db, c.Design, c.Design == DesignWait); err != nil {
+		return nil, stack(err, "db: %s", db.host)
+	}
+	return db, nil
+}
+
+// defaultUserAgent is the User-Agent header of requests unless configured otherwise.
+const defaultUserAgent = "toople-db"
+
+// userAgent is an http.RoundTripper setting the User-Agent header of requests.
+type userAgent struct {
+	rt http.RoundTripper
+	ua string
+}
+
+func (t *userAgent) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("User-Agent", t.ua)
+	return t.rt.RoundTrip(r)
+}
+
+// check tests the connection to the server and makes sure it is CouchDB.
+func (db *CouchDB) check() error {
+	r, err := db.client.Head(db.server)
+	if err != nil {
+		return fmt.Errorf("db: %s: connection refused", db.host)
+	}
+	r.Body.Close()
+	if !strings.HasPrefix(r.Header.Get("Server"), "CouchDB") {
+		return fmt.Errorf("db: %s is not CouchDB", db.host)
+	}
+	switch r.StatusCode {
+	case 200:
+	default:
+		return fmt.Errorf("db: %s: status %d", db.host, r.StatusCode)
+	}
+	return nil
+}
+
+// authenticate opens a session on the server and checks read/write access.
+// Unless called from DialCouchDB, the caller must hold db.mu.
+func (db *CouchDB) authenticate(ctx context.Context) error {
+	p := fmt.Sprintf("name=%s&password=%s", url.QueryEscape(db.username), url.QueryEscape(db.password))
+	req, err := http.NewRequestWithContext(ctx, "POST", db.server+"_session", strings.NewReader(p))
+	if err != nil {
+		return stack(err, "db: %s: error creating session request", db.host)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r, err := db.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("db: %s: connection refused", db.host)
+	}
+	defer r.Body.Close()
+	switch r.StatusCode {
+	case 200:
+	case 401:
+		return stack(ErrUnauthorized, "db: %s", db.host)
+	default:
+		return fmt.Errorf("db: %s: status %d", db.host, r.StatusCode)
+	}
+
+	// Check role (read/write access)
+	var v struct{ Roles []string }
+	d := json.NewDecoder(r.Body)
+	if err = d.Decode(&v); err != nil {
+		return fmt.Errorf("db: %s: bad JSON in database response", db.host)
+	}
+	for _, role := range v.Roles {
+		if role == "db" {
+			db.session++
+			db.renewAt = time.Now().Add(db.timeout * 9 / 10)
+			db.touch(r)
+			return nil
+		}
+	}
+	return stack(ErrForbidden, "db: %s: read or write permission denied", db.host)
+}
+
+// Get decodes the document with the given id into doc.
+func (db *CouchDB) Get(ctx context.Context, id string, doc interface{}) error {
+	s, err := db.get(ctx, docPath(id), doc)
+	if err != nil {
+		return stack(err, "couchdb: cannot get %q", id)
+	}
+	if s != http.StatusOK {
+		return &BackendError{Op: fmt.Sprintf("get %q", id), Status: s}
+	}
+	return nil
+}
+
+// getIfNoneMatch decodes the document with the given id into doc, unless its revision is still rev.
+// It reports whether the document was modified.
+func (db *CouchDB) getIfNoneMatch(ctx context.Context, id, rev string, doc interface{}) (bool, error) {
+	h := http.Header{"If-None-Match": {strconv.Quote(rev)}}
+	s, err := db.request(ctx, "GET", docPath(id), h, nil, doc)
+	if err != nil {
+		return false, stack(err, "couchdb: cannot get %q", id)
+	}
+	switch s {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+		return true, nil
+	}
+	return false, &BackendError{Op: fmt.Sprintf("get %q", id), Status: s}
+}
+
+// getAll returns the documents with the given ids as raw JSON, in order,
+// fetched in a single request to _all_docs. Missing and deleted documents are null.
+func (db *CouchDB) getAll(ctx context.Context, ids []string) ([]json.RawMessage, error) {
+	var v struct {
+		Rows []struct{ Doc json.RawMessage }
+	}
+	keys := struct {
+		Keys []string `json:"keys"`
+	}{ids}
+	s, err := db.post(ctx, "_all_docs?include_docs=true", &keys, &v)
+	if err != nil {
+		return nil, stack(err, "couchdb: cannot get documents")
+	}
+	if s != http.StatusOK {
+		return nil, &BackendError{Op: "all docs", Status: s}
+	}
+	if len(v.Rows) != len(ids) {
+		return nil, fmt.Errorf("couchdb: all docs: got %d rows for %d keys", len(v.Rows), len(ids))
+	}
+	docs := make([]json.RawMessage, len(ids))
+	for i, r := range v.Rows {
+		docs[i] = r.Doc
+	}
+	return docs, nil
+}
+
+// Create stores a new document and returns its generated id and revision.
+func (db *CouchDB) Create(ctx context.Context, doc interface{}) (string, string, error) {
+	var r struct{ Id, Rev string }
+	s, err := db.post(ctx, "", doc, &r)
+	if err != nil {
+		return "", "", stack(err, "couchdb: cannot create document")
+	}
+	if s != http.StatusCreated && s != http.StatusAccepted {
+		return "", "", &BackendError{Op: "create", Status: s}
+	}
+	return r.Id, r.Rev, nil
+}
+
+// CreateAll stores new documents with a single request to _bulk_docs.
+func (db *CouchDB) CreateAll(ctx context.Context, docs []interface{}) ([]BulkResult, error) {
+	in := struct {
+		Docs []interface{} `json:"docs"`
+	}{docs}
+	var b json.RawMessage // an array of results, or an error object
+	s, err := db.post(ctx, "_bulk_docs", &in, &b)
+	if err != nil {
+		return nil, stack(err, "couchdb: cannot create documents")
+	}
+	if s != http.StatusCreated && s != http.StatusAccepted {
+		return nil, &BackendError{Op: "bulk docs", Status: s}
+	}
+	var v []struct {
+		Id, Rev       string
+		Error, Reason string
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, stack(err, "couchdb: bulk docs: error decoding JSON")
+	}
+	if len(v) != len(docs) {
+		return nil, fmt.Errorf("couchdb: bulk docs: got %d results for %d documents", len(v), len(docs))
+	}
+	res := make([]BulkResult, len(v))
+	for i, r := range v {
+		res[i] = BulkResult{Id: r.Id, Rev: r.Rev}
+		switch r.Error {
+		case "":
+		case "conflict":
+			res[i].Err = stack(ErrConflict, "couchdb: %s", r.Reason)
+		case "forbidden":
+			res[i].Err = stack(ErrForbidden, "couchdb: %s", r.Reason)
+		case "unauthorized":
+			res[i].Err = stack(ErrUnauthorized, "couchdb: %s", r.Reason)
+		default:
+			res[i].Err = fmt.Errorf("couchdb: %s: %s", r.Error, r.Reason)
+		}
+	}
+	return res, nil
+}
+
+// Put creates or updates the document with the given id and returns its new revision.
+func (db *CouchDB) Put(ctx context.Context, id string, doc interface{}) (string, error) {
+	var r struct{ Rev string }
+	s, err := db.request(ctx, "PUT", docPath(id), nil, doc, &r)
+	if err != nil {
+		return "", stack(err, "couchdb: cannot put %q", id)
+	}
+	if s != http.StatusCreated && s != http.StatusAccepted {
+		return "", &BackendError{Op: fmt.Sprintf("put %q", id), Status: s}
+	}
+	return r.Rev, nil
+}
+
+// Delete removes the document with the given id and revision.
+func (db *CouchDB) Delete(ctx context.Context, id, rev string) error {
+	s, err := db.delete(ctx, docPath(id), url.QueryEscape(rev))
+	if err != nil {
+		return stack(err, "couchdb: cannot delete %q", id)
+	}
+	if s != http.StatusOK && s != http.StatusAccepted {
+		return &BackendError{Op: fmt.Sprintf("delete %q", id), Status: s}
+	}
+	return nil
+}
+
+// Infos returns the metadata of documents, in the order of ids.
+// They are fetched in a single request to _all_docs.
+func (db *CouchDB) Infos(ctx context.Context, ids []string) ([]DocInfo, error) {
+	var v struct {
+		Rows []struct {
+			Key   string
+			Value struct {
+				Rev     string
+				Deleted bool
+			}
+			Doc *struct{ Type string }
+		}
+	}
+	keys := struct {
+		Keys []string `json:"keys"`
+	}{ids}
+	s, err := db.post(ctx, "_all_docs?include_docs=true", &keys, &v)
+	if err != nil {
+		return nil, stack(err, "couchdb: cannot get document infos")
+	}
+	if s != http.StatusOK {
+		return nil, &BackendError{Op: "all docs", Status: s}
+	}
+	if len(v.Rows) != len(ids) {
+		return nil, fmt.Errorf("couchdb: all docs: got %d rows for %d keys", len(v.Rows), len(ids))
+	}
+	infos := make([]DocInfo, len(ids))
+	for i, r := range v.Rows {
+		infos[i] = DocInfo{
+			Id:      ids[i],
+			Rev:     r.Value.Rev,
+			Deleted: r.Value.Deleted,
+		}
+		if r.Doc != nil {
+			infos[i].Type = r.Doc.Type
+		}
+	}
+	return infos, nil
+}
+
+// Query decodes the rows of a view matching key into out.
+func (db *CouchDB) Query(ctx context.Context, view View, key string, includeDocs bool, out interface{}) error {
+	path := db.view(string(view), key, includeDocs)
+	if view.Dated() {
+		path = db.dateView(string(view), key, includeDocs)
+	}
+	s, err := db.get(ctx, path, out)
+	if err != nil {
+		return stack(err, "couchdb: error querying %s view", view)
+	}
+	if s != http.StatusOK {
+		return &BackendError{Op: string(view) + " view", Status: s}
+	}
+	return nil
+}
+
+// scanPage is the number of documents fetched by each request of Scan.
+const scanPage = 100
+
+// Scan calls fn with every document whose id sorts after the given one, in id order.
+// Documents are fetched from _all_docs by pages.
+func (db *CouchDB) Scan(ctx context.Context, after string, fn func(doc map[string]interface{}) error) error {
+	for {
+		var v struct {
+			Rows []struct {
+				Id  string
+				Doc map[string]interface{}
+			}
+		}
+		k, _ := json.Marshal(after) // cannot fail
+		path := fmt.Sprintf("_all_docs?include_docs=true&limit=%d&startkey=%s", scanPage+1, url.QueryEscape(string(k)))
+		s, err := db.get(ctx, path, &v)
+		if err != nil {
+			return stack(err, "couchdb: error scanning documents")
+		}
+		if s != http.StatusOK {
+			return &BackendError{Op: "all docs", Status: s}
+		}
+		n := 0
+		for _, r := range v.Rows {
+			if r.Id <= after {
+				continue // startkey is inclusive
+			}
+			after = r.Id
+			n++
+			if strings.HasPrefix(r.Id, "_design/") || r.Doc == nil {
+				continue
+			}
+			if err := fn(r.Doc); err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+}
+
+// changesPoll is how long a request to the changes feed waits for changes,
+// unless the request timeout of the client is shorter.
+const changesPoll = 30 * time.Second
+
+// Changes returns the changes after the since sequence and the sequence to pass next.
+// If wait is true, the changes feed is long-polled.
+func (db *CouchDB) Changes(ctx context.Context, since string, wait bool) ([]Change, string, error) {
+	path := "_changes?include_docs=true&since=" + url.QueryEscape(since)
+	if since == "" {
+		path = "_changes?include_docs=true"
+	}
+	if wait {
+		poll := changesPoll
+		if t := db.client.Timeout; t > 0 && t < 2*poll {
+			poll = t / 2
+		}
+		path += fmt.Sprintf("&feed=longpoll&timeout=%d", poll.Milliseconds())
+	}
+	var v struct {
+		Results []struct {
+			Seq     json.RawMessage
+			Id      string
+			Deleted bool
+			Doc     map[string]interface{}
+		}
+		LastSeq json.RawMessage `json:"last_seq"`
+	}
+	s, err := db.get(ctx, path, &v)
+	if err != nil {
+		return nil, "", stack(err, "couchdb: cannot get changes")
+	}
+	if s != http.StatusOK {
+		return nil, "", &BackendError{Op: "changes", Status: s}
+	}
+	changes := make([]Change, len(v.Results))
+	for i, r := range v.Results {
+		changes[i] = Change{Seq: seq(r.Seq), Id: r.Id, Deleted: r.Deleted}
+		if !r.Deleted {
+			changes[i].Doc = r.Doc
+		}
+	}
+	return changes, seq(v.LastSeq), nil
+}
+
+// seq returns a sequence of the changes feed as a string:
+// sequences are numbers up to CouchDB 1.x, opaque strings since.
+func seq(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// docPath returns the escaped path of a document, leaving design document prefixes alone.
+func docPath(id string) string {
+	if strings.HasPrefix(id, "_design/") {
+		return "_design/" + url.PathEscape(id[len("_design/"):])
+	}
+	return url.PathEscape(id)
+}
+
+// view gives the URL of a view including queries for a key and if docs should be returned
+func (db *CouchDB) view(view, key string, include_docs bool) string {
+	return fmt.Sprintf(`_design/toople/_view/%s?key="%s"&include_docs=%t`, view, url.QueryEscape(key), include_docs)
+}
+
+// dateView gives the URL of a view keyed by [key, date] including queries for a key and if docs should be returned
+func (db *CouchDB) dateView(view, key string, include_docs bool) string {
+	return fmt.Sprintf(`_design/toople/_view/%s?startkey=["%s"]&endkey=["%[2]s",{}]`+
+		`&include_docs=%t`, view, url.QueryEscape(key), include_docs)
+}
+
+// request performs an http request against the database
+// within a span tagged with its view or document and its status.
+func (db *CouchDB) request(ctx context.Context, method, path string, header http.Header, in, out interface{}) (_ int, err error) {
+	name, attrs := requestSpan(method, path)
+	ctx, span := db.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	defer func() { endSpan(span, err) }()
+
+	var body []byte
+
+	// Encode JSON
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return http.StatusInternalServerError, stack(err, "request: error encoding JSON")
+		}
+		body = b
+	}
+
+	// Request
+	res, err := db.do(ctx, method, path, header, body)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer res.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+
+	// Decode JSON
+	if out != nil && method != "HEAD" && res.StatusCode != http.StatusNotModified {
+		d := json.NewDecoder(res.Body)
+		if err := d.Decode(out); err != nil {
+			return res.StatusCode, stack(err, "request: error decoding JSON")
+		}
+	}
+
+	return res.StatusCode, nil
+}
+
+// do sends an http request to the database and returns the response.
+// Transient failures are retried according to the retry policy
+// and the request fails fast while the circuit breaker is open.
+func (db *CouchDB) do(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	idem := idempotent(method, path, body)
+	for n := 0; ; n++ {
+		if err := db.breaker.allow(); err != nil {
+			return nil, err
+		}
+		res, err := db.authorized(ctx, method, path, header, body)
+		if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+			db.breaker.release() // the caller gave up: it says nothing of the server
+		} else {
+			db.breaker.record(err == nil && res.StatusCode < 500)
+		}
+		if n >= db.retry.MaxRetries || !transient(idem, res, err) || ctx.Err() != nil {
+			return res, err
+		}
+		d := db.retry.backoff(n, res)
+		if res != nil {
+			res.Body.Close()
+		}
+		if err := sleep(ctx, d); err != nil {
+			return nil, stack(err, "request: cancelled while waiting to retry")
+		}
+	}
+}
+
+// BreakerState returns the state of the circuit breaker.
+func (db *CouchDB) BreakerState() BreakerState {
+	return db.breaker.State()
+}
+
+// authorized sends an http request to the database and returns the response.
+// The session is renewed when it is about to expire, or when the server rejects it,
+// in which case the request is replayed once.
+func (db *CouchDB) authorized(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	session, err := db.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := db.send(ctx, method, path, header, body)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	res.Body.Close()
+	if err := db.renew(ctx, session); err != nil {
+		return nil, err
+	}
+	return db.send(ctx, method, path, header, body)
+}
+
+// send sends a single http request to the database, with additional headers if any.
+func (db *CouchDB) send(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, db.url+"/"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, stack(err, "request: error creating HTTP request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := db.client.Do(req)
+	if err != nil {
+		return nil, stack(err, "request: error sending HTTP request")
+	}
+	db.mu.Lock()
+	db.touch(res)
+	db.mu.Unlock()
+	return res, nil
+}
+
+// get performs a get request against the database
+func (db *CouchDB) get(ctx context.Context, path string, out interface{}) (int, error) {
+	return db.request(ctx, "GET", path, nil, nil, out)
+}
+
+// post performs a post request against the database
+func (db *CouchDB) post(ctx context.Context, path string, in, out interface{}) (int, error) {
+	return db.request(ctx, "POST", path, nil, in, out)
+}
+
+// delete performs a delete request against the database
+func (db *CouchDB) delete(ctx context.Context, id, rev string) (int, error) {
+	return db.request(ctx, "DELETE", fmt.Sprintf("%s?rev=%s", id, rev), nil, nil, nil)
+}
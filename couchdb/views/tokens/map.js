@@ -0,0 +1,5 @@
+function(doc) {
+	if (doc.type == 'verification' || doc.type == 'reset') {
+		emit(doc.user, doc.type);
+	}
+}
@@ -0,0 +1,550 @@
+/*
+Package couchtest implements a fake CouchDB server for testing code using the db package.
+
+The server speaks enough of the CouchDB HTTP API for the db package:
+cookie sessions, document CRUD with revisions and conflicts, _all_docs, _bulk_docs, _changes
+and the views of the toople design document, which are backed by a db.Memory store.
+Faults (latency, error statuses, malformed JSON) can be injected to exercise error paths.
+
+	s := couchtest.NewServer()
+	defer s.Close()
+	s.Memory.LoadDir("couchdb/_docs")
+	d, err := db.Open(s.DSN())
+*/
+package couchtest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	db "github.com/toople-co/toople-db"
+)
+
+// Default credentials and database name of a new server.
+const (
+	Username = "test"
+	Password = "test"
+	Database = "toople"
+)
+
+// A Server is a fake CouchDB server.
+type Server struct {
+	*httptest.Server
+
+	// Memory holds the documents of the database.
+	Memory *db.Memory
+
+	// SessionTimeout is the lifetime of sessions, 10 minutes by default.
+	SessionTimeout time.Duration
+
+	mu       sync.Mutex
+	users    map[string]account
+	sessions map[string]session
+	faults   []*Fault
+	requests int
+}
+
+// An account is a CouchDB user.
+type account struct {
+	password string
+	roles    []string
+}
+
+// A session is an open CouchDB session.
+type session struct {
+	name    string
+	expires time.Time
+}
+
+// NewServer starts a fake CouchDB server with an empty database named Database
+// and a user with the Username and Password credentials and the "db" role.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		Memory:         db.NewMemory(),
+		SessionTimeout: 10 * time.Minute,
+		users:          make(map[string]account),
+		sessions:       make(map[string]session),
+	}
+	s.AddUser(Username, Password, "db")
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// AddUser adds a user with the given roles.
+func (s *Server) AddUser(name, password string, roles ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[name] = account{password, roles}
+}
+
+// DSN returns the connection URL of the database with the default credentials,
+// to be given to db.Open.
+func (s *Server) DSN() string {
+	u, _ := url.Parse(s.URL) // httptest URLs are valid
+	u.User = url.UserPassword(Username, Password)
+	u.Path = "/" + Database
+	return u.String()
+}
+
+// Open connects to the database with the default credentials and the given options.
+func (s *Server) Open(opts ...db.Option) (*db.DB, error) {
+	return db.Open(s.DSN(), opts...)
+}
+
+// ExpireSessions ends all sessions, as if their cookies had expired.
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = make(map[string]session)
+}
+
+// Requests returns the number of requests served so far.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// serve dispatches a request.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	s.mu.Unlock()
+	w.Header().Set("Server", "CouchDB/1.6.1 (Erlang OTP/R16B03) couchtest")
+	if s.fault(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case path == "":
+		writeJSON(w, http.StatusOK, map[string]string{"couchdb": "Welcome", "version": "1.6.1"})
+	case path == "_session":
+		s.serveSession(w, r)
+	case path == Database || strings.HasPrefix(path, Database+"/"):
+		if !s.authorized(r) {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "You are not authorized to access this db.")
+			return
+		}
+		s.serveDatabase(w, r, strings.TrimPrefix(strings.TrimPrefix(path, Database), "/"))
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "no_db_file")
+	}
+}
+
+// serveSession serves the _session endpoint.
+func (s *Server) serveSession(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var name, password string
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			var v struct{ Name, Password string }
+			json.NewDecoder(r.Body).Decode(&v)
+			name, password = v.Name, v.Password
+		} else {
+			r.ParseForm()
+			name, password = r.PostForm.Get("name"), r.PostForm.Get("password")
+		}
+		s.mu.Lock()
+		a, ok := s.users[name]
+		if !ok || a.password != password {
+			s.mu.Unlock()
+			writeError(w, http.StatusUnauthorized, "unauthorized", "Name or password is incorrect.")
+			return
+		}
+		token := newToken()
+		s.sessions[token] = session{name, time.Now().Add(s.SessionTimeout)}
+		s.mu.Unlock()
+		http.SetCookie(w, &http.Cookie{Name: "AuthSession", Value: token, Path: "/", HttpOnly: true})
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "name": name, "roles": a.roles})
+	case "GET":
+		name := s.user(r)
+		s.mu.Lock()
+		roles := s.users[name].roles
+		s.mu.Unlock()
+		var n interface{}
+		if name != "" {
+			n = name
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ok":      true,
+			"userCtx": map[string]interface{}{"name": n, "roles": roles},
+		})
+	case "DELETE":
+		if c, err := r.Cookie("AuthSession"); err == nil {
+			s.mu.Lock()
+			delete(s.sessions, c.Value)
+			s.mu.Unlock()
+		}
+		http.SetCookie(w, &http.Cookie{Name: "AuthSession", Value: "", Path: "/", MaxAge: -1})
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET,POST,DELETE allowed")
+	}
+}
+
+// user returns the name of the user of the session of a request, or "" if there is none.
+func (s *Server) user(r *http.Request) string {
+	c, err := r.Cookie("AuthSession")
+	if err != nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.sessions[c.Value]
+	if !ok || time.Now().After(t.expires) {
+		delete(s.sessions, c.Value)
+		return ""
+	}
+	return t.name
+}
+
+// authorized reports whether a request belongs to a session.
+func (s *Server) authorized(r *http.Request) bool {
+	return s.user(r) != ""
+}
+
+// serveDatabase serves the requests to the database, path being relative to it.
+func (s *Server) serveDatabase(w http.ResponseWriter, r *http.Request, path string) {
+	ctx := r.Context()
+	switch {
+	case path == "":
+		switch r.Method {
+		case "GET", "HEAD":
+			writeJSON(w, http.StatusOK, map[string]string{"db_name": Database})
+		case "POST":
+			var d map[string]interface{}
+			if !readJSON(w, r, &d) {
+				return
+			}
+			id, rev, err := s.Memory.Create(ctx, d)
+			writeWrite(w, id, rev, err)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET,HEAD,POST allowed")
+		}
+	case path == "_all_docs":
+		s.serveAllDocs(w, r)
+	case path == "_bulk_docs":
+		s.serveBulkDocs(w, r)
+	case path == "_changes":
+		s.serveChanges(w, r)
+	case strings.HasPrefix(path, "_design/toople/_view/"):
+		s.serveView(w, r, db.View(strings.TrimPrefix(path, "_design/toople/_view/")))
+	default:
+		s.serveDoc(w, r, path)
+	}
+}
+
+// serveDoc serves the requests to a single document.
+func (s *Server) serveDoc(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	switch r.Method {
+	case "GET", "HEAD":
+		infos, _ := s.Memory.Infos(ctx, []string{id})
+		if !infos[0].Exists() {
+			reason := "missing"
+			if infos[0].Deleted {
+				reason = "deleted"
+			}
+			writeError(w, http.StatusNotFound, "not_found", reason)
+			return
+		}
+		etag := strconv.Quote(infos[0].Rev)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		var d map[string]interface{}
+		s.Memory.Get(ctx, id, &d)
+		writeJSON(w, http.StatusOK, d)
+	case "PUT":
+		var d map[string]interface{}
+		if !readJSON(w, r, &d) {
+			return
+		}
+		if rev := r.URL.Query().Get("rev"); rev != "" {
+			d["_rev"] = rev
+		}
+		rev, err := s.Memory.Put(ctx, id, d)
+		writeWrite(w, id, rev, err)
+	case "DELETE":
+		rev := r.URL.Query().Get("rev")
+		if err := s.Memory.Delete(ctx, id, rev); err != nil {
+			writeWrite(w, id, "", err)
+			return
+		}
+		infos, _ := s.Memory.Infos(ctx, []string{id})
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "id": id, "rev": infos[0].Rev})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET,HEAD,PUT,DELETE allowed")
+	}
+}
+
+// An allDocsRow is a row of _all_docs.
+type allDocsRow struct {
+	Id    string                 `json:"id,omitempty"`
+	Key   string                 `json:"key"`
+	Value interface{}            `json:"value,omitempty"`
+	Doc   map[string]interface{} `json:"doc,omitempty"`
+	Error string                 `json:"error,omitempty"`
+}
+
+// serveAllDocs serves _all_docs, either for given keys (POST) or for a range of ids (GET).
+func (s *Server) serveAllDocs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	docs := q.Get("include_docs") == "true"
+	rows := make([]allDocsRow, 0)
+	switch r.Method {
+	case "POST":
+		var v struct{ Keys []string }
+		if !readJSON(w, r, &v) {
+			return
+		}
+		infos, _ := s.Memory.Infos(ctx, v.Keys)
+		for _, i := range infos {
+			row := allDocsRow{Id: i.Id, Key: i.Id}
+			switch {
+			case i.Rev == "":
+				row = allDocsRow{Key: i.Id, Error: "not_found"}
+			case i.Deleted:
+				row.Value = map[string]interface{}{"rev": i.Rev, "deleted": true}
+			default:
+				row.Value = map[string]string{"rev": i.Rev}
+				if docs {
+					s.Memory.Get(ctx, i.Id, &row.Doc)
+				}
+			}
+			rows = append(rows, row)
+		}
+	case "GET":
+		var start string
+		if k := q.Get("startkey"); k != "" {
+			if err := json.Unmarshal([]byte(k), &start); err != nil {
+				writeError(w, http.StatusBadRequest, "bad_request", "invalid startkey")
+				return
+			}
+		}
+		limit, err := strconv.Atoi(q.Get("limit"))
+		if err != nil {
+			limit = -1
+		}
+		errLimit := errors.New("limit reached")
+		err = s.Memory.Scan(ctx, "", func(d map[string]interface{}) error {
+			id := d["_id"].(string)
+			if id < start {
+				return nil
+			}
+			if len(rows) == limit {
+				return errLimit
+			}
+			row := allDocsRow{Id: id, Key: id, Value: map[string]interface{}{"rev": d["_rev"]}}
+			if docs {
+				row.Doc = d
+			}
+			rows = append(rows, row)
+			return nil
+		})
+		if err != nil && err != errLimit {
+			writeError(w, http.StatusInternalServerError, "error", err.Error())
+			return
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET,POST allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"total_rows": len(rows), "offset": 0, "rows": rows})
+}
+
+// serveBulkDocs serves _bulk_docs. It is not atomic, like CouchDB 2.
+func (s *Server) serveBulkDocs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only POST allowed")
+		return
+	}
+	var v struct{ Docs []map[string]interface{} }
+	if !readJSON(w, r, &v) {
+		return
+	}
+	res := make([]map[string]interface{}, len(v.Docs))
+	for i, d := range v.Docs {
+		id, _ := d["_id"].(string)
+		var rev string
+		var err error
+		switch {
+		case d["_deleted"] == true:
+			r, _ := d["_rev"].(string)
+			err = s.Memory.Delete(ctx, id, r)
+		case d["_rev"] != nil:
+			rev, err = s.Memory.Put(ctx, id, d)
+		default:
+			id, rev, err = s.Memory.Create(ctx, d)
+			if id == "" {
+				id, _ = d["_id"].(string)
+			}
+		}
+		res[i] = map[string]interface{}{"id": id}
+		if err != nil {
+			code, e, _ := errorStatus(err)
+			res[i]["error"], res[i]["reason"] = e, http.StatusText(code)
+		} else {
+			res[i]["ok"], res[i]["rev"] = true, rev
+		}
+	}
+	writeJSON(w, http.StatusCreated, res)
+}
+
+// serveChanges serves the _changes feed, either normal or longpoll.
+// Sequences are numbers, like CouchDB 1.x.
+func (s *Server) serveChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET allowed")
+		return
+	}
+	q := r.URL.Query()
+	since := q.Get("since")
+	if since == "0" {
+		since = ""
+	}
+	wait := q.Get("feed") == "longpoll"
+	ctx := r.Context()
+	if wait {
+		timeout := 60 * time.Second
+		if ms, err := strconv.Atoi(q.Get("timeout")); err == nil {
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	changes, last, err := s.Memory.Changes(ctx, since, wait)
+	if errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil {
+		changes, last, err = s.Memory.Changes(r.Context(), since, false) // timed out: no changes
+	}
+	if err != nil {
+		code, e, reason := errorStatus(err)
+		if errors.Is(err, db.ErrInvalid) {
+			code, e, reason = http.StatusBadRequest, "bad_request", "invalid since"
+		}
+		writeError(w, code, e, reason)
+		return
+	}
+	docs := q.Get("include_docs") == "true"
+	results := make([]map[string]interface{}, len(changes))
+	for i, c := range changes {
+		seq, _ := strconv.Atoi(c.Seq)
+		res := map[string]interface{}{"seq": seq, "id": c.Id}
+		if c.Deleted {
+			res["deleted"] = true
+			if docs {
+				res["doc"] = map[string]interface{}{"_id": c.Id, "_deleted": true}
+			}
+		} else if docs {
+			res["doc"] = c.Doc
+		}
+		if c.Doc != nil {
+			res["changes"] = []map[string]interface{}{{"rev": c.Doc["_rev"]}}
+		}
+		results[i] = res
+	}
+	n, _ := strconv.Atoi(last)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results, "last_seq": n})
+}
+
+// serveView serves a view of the toople design document,
+// queried either by key or by the [key] to [key, {}] range of dated views.
+func (s *Server) serveView(w http.ResponseWriter, r *http.Request, v db.View) {
+	q := r.URL.Query()
+	var key string
+	if k := q.Get("key"); k != "" {
+		if err := json.Unmarshal([]byte(k), &key); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "invalid key")
+			return
+		}
+	} else if k := q.Get("startkey"); k != "" {
+		var ks []string
+		if err := json.Unmarshal([]byte(k), &ks); err != nil || len(ks) == 0 {
+			writeError(w, http.StatusBadRequest, "bad_request", "invalid startkey")
+			return
+		}
+		key = ks[0]
+	}
+	var out json.RawMessage
+	if err := s.Memory.Query(r.Context(), v, key, q.Get("include_docs") == "true", &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "error", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// readJSON decodes the body of a request, or replies with a bad request error.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid UTF-8 JSON")
+		return false
+	}
+	return true
+}
+
+// writeWrite replies to a document write.
+func writeWrite(w http.ResponseWriter, id, rev string, err error) {
+	if err != nil {
+		code, e, reason := errorStatus(err)
+		writeError(w, code, e, reason)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": id, "rev": rev})
+}
+
+// errorStatus returns the CouchDB status and error names of an error of the memory store.
+func errorStatus(err error) (int, string, string) {
+	switch {
+	case errors.Is(err, db.ErrConflict):
+		return http.StatusConflict, "conflict", "Document update conflict."
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound, "not_found", "missing"
+	case errors.Is(err, context.Canceled):
+		return http.StatusInternalServerError, "error", "cancelled"
+	}
+	return http.StatusInternalServerError, "error", err.Error()
+}
+
+// writeJSON replies with a JSON value.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError replies with a CouchDB error.
+func writeError(w http.ResponseWriter, code int, e, reason string) {
+	writeJSON(w, code, map[string]string{"error": e, "reason": reason})
+}
+
+// newToken returns a random session token.
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// String describes the server.
+func (s *Server) String() string {
+	return fmt.Sprintf("couchtest.Server(%s)", s.URL)
+}
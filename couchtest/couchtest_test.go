@@ -0,0 +1,364 @@
+package couchtest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	db "github.com/toople-co/toople-db"
+	"github.com/toople-co/toople-db/couchtest"
+)
+
+// newServer starts a server loaded with the fixtures of couchdb/_docs.
+func newServer(t *testing.T) *couchtest.Server {
+	t.Helper()
+	s := couchtest.NewServer()
+	t.Cleanup(s.Close)
+	if err := s.Memory.LoadDir("../couchdb/_docs"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// dial connects to the server with a CouchDB store configured by f.
+func dial(t *testing.T, s *couchtest.Server, f func(*db.CouchDBConfig)) *db.CouchDB {
+	t.Helper()
+	c, err := db.ParseCouchDBURL(s.DSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Retry = db.RetryPolicy{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	if f != nil {
+		f(&c)
+	}
+	st, err := db.DialCouchDB(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestOpen(t *testing.T) {
+	s := newServer(t)
+	d, err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := d.GetNotifications("u0sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n) != 8 {
+		t.Errorf("got %d notifications, want 8", len(n))
+	}
+	u, err := d.NewUser("Bob", "bob@example.com", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.NewUser("Bob", "bob@example.com", "password1"); !errors.Is(err, db.ErrEmailTaken) {
+		t.Errorf("got %v, want ErrEmailTaken", err)
+	}
+	if ok, _, err := d.AuthUser("bob@example.com", "password1"); !ok || err != nil {
+		t.Errorf("got %v, %v, want successful authentication", ok, err)
+	}
+	id, err := d.NewCircle("Bobs", "bobs", u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.NewCircle("Bobs", "bobs", u.Id); !errors.Is(err, db.ErrSlugTaken) {
+		t.Errorf("got %v, want ErrSlugTaken", err)
+	}
+	if err := d.NewEvent(time.Now().Add(time.Hour), "Home", "Party", "", u.Id, 2, []string{id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.JoinEvent("e0swim", "u0sim"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.GetCircles(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 1 || c[0].Id != id {
+		t.Errorf("got circles %v, want %q", c, id)
+	}
+}
+
+func TestCRUD(t *testing.T) {
+	s := newServer(t)
+	st := dial(t, s, nil)
+	ctx := context.Background()
+
+	id, rev, err := st.Create(ctx, map[string]string{"type": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d map[string]interface{}
+	if err := st.Get(ctx, id, &d); err != nil || d["_rev"] != rev {
+		t.Fatalf("got %v, %v, want revision %s", d, err, rev)
+	}
+	rev2, err := st.Put(ctx, id, map[string]string{"_rev": rev, "type": "test", "v": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Put(ctx, id, map[string]string{"_rev": rev, "type": "test"}); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("put of an old revision: got %v, want ErrConflict", err)
+	}
+	if err := st.Delete(ctx, id, rev); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("delete of an old revision: got %v, want ErrConflict", err)
+	}
+	if err := st.Delete(ctx, id, rev2); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Get(ctx, id, &d); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("get of a deleted document: got %v, want ErrNotFound", err)
+	}
+	var be *db.BackendError
+	if err := st.Get(ctx, "nobody", &d); !errors.As(err, &be) || be.Status != http.StatusNotFound {
+		t.Errorf("got %v, want a 404 BackendError", err)
+	}
+
+	infos, err := st.Infos(ctx, []string{"u0sim", id, "nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !infos[0].Exists() || infos[0].Type != "user" || !infos[1].Deleted || infos[2].Rev != "" {
+		t.Errorf("got infos %+v", infos)
+	}
+
+	var v struct{ Rows []struct{ Id string } }
+	if err := st.Query(ctx, db.ViewMembers, "c0kus", false, &v); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"m0kus1kus", "m0amin1kus", "m0imene1kus", "m0sim1kus"}
+	if len(v.Rows) != len(want) {
+		t.Fatalf("got %d members, want %d", len(v.Rows), len(want))
+	}
+	for i, r := range v.Rows {
+		if r.Id != want[i] {
+			t.Errorf("member %d: got %q, want %q", i, r.Id, want[i])
+		}
+	}
+}
+
+func TestServerError(t *testing.T) {
+	s := newServer(t)
+	st := dial(t, s, func(c *db.CouchDBConfig) { c.Retry.MaxRetries = 2 })
+	d := db.NewWithStore(st)
+
+	// Transient errors are retried
+	f := couchtest.ServerError
+	f.Path, f.Times = "_view/circles", 2
+	s.Inject(f)
+	n := s.Requests()
+	if _, err := d.GetCircles("u0sim"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Requests() - n; got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+
+	// Until retries are exhausted
+	s.Inject(couchtest.ServerError)
+	n = s.Requests()
+	_, err := d.GetCircles("u0sim")
+	var be *db.BackendError
+	if !errors.As(err, &be) || be.Status != http.StatusInternalServerError {
+		t.Errorf("got %v, want a 500 BackendError", err)
+	}
+	if got := s.Requests() - n; got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	s := newServer(t)
+	d, err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Inject(couchtest.Unauthorized)
+	if _, err := d.GetCircles("u0sim"); !errors.Is(err, db.ErrUnauthorized) {
+		t.Errorf("got %v, want ErrUnauthorized", err)
+	}
+	s.Reset()
+	if _, err := d.GetCircles("u0sim"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMalformedJSON(t *testing.T) {
+	s := newServer(t)
+	d, err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Inject(couchtest.MalformedJSON)
+	if _, err := d.GetCircles("u0sim"); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want a truncated JSON error", err)
+	}
+}
+
+func TestBulkDocsError(t *testing.T) {
+	s := newServer(t)
+	d, err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forbidden := couchtest.Fault{Status: http.StatusForbidden, Body: `{"error":"forbidden","reason":"Only admins may create events."}`}
+	tooLarge := couchtest.Fault{Status: http.StatusRequestEntityTooLarge, Body: `{"error":"too_large","reason":"the request entity is too large"}`}
+	for _, c := range []struct {
+		fault  couchtest.Fault
+		status int
+		target error
+	}{
+		{forbidden, http.StatusForbidden, db.ErrForbidden},
+		{couchtest.Unauthorized, http.StatusUnauthorized, db.ErrUnauthorized},
+		{tooLarge, http.StatusRequestEntityTooLarge, nil},
+		{couchtest.ServerError, http.StatusInternalServerError, nil},
+	} {
+		// The error object replied by _bulk_docs is reported as the status, not as malformed results
+		f := c.fault
+		f.Path = "_bulk_docs"
+		s.Inject(f)
+		err := d.NewEvent(time.Now().Add(time.Hour), "Home", "Party", "", "u0sim", 2, []string{"c0kus"})
+		s.Reset()
+		var be *db.BackendError
+		if !errors.As(err, &be) || be.Status != c.status {
+			t.Errorf("got %v, want a %d BackendError", err, c.status)
+		}
+		if c.target != nil && !errors.Is(err, c.target) {
+			t.Errorf("got %v, want %v", err, c.target)
+		}
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	s := newServer(t)
+	d, err := s.Open(db.WithCache(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A wrong password only reads the user
+	read := func() {
+		t.Helper()
+		if err := d.ChangePassword("u0sim", "wrong", "password2"); !errors.Is(err, db.ErrUnauthorized) {
+			t.Fatalf("got %v, want ErrUnauthorized", err)
+		}
+	}
+	read()
+	read() // 304 Not Modified
+	if st := d.CacheStats(); st.Misses != 1 || st.Revalidations != 1 || st.Hits != 1 {
+		t.Fatalf("got %+v, want 1 miss, then 1 hit after revalidation", st)
+	}
+
+	// A document changed behind the back of the cache is fetched again
+	ctx := context.Background()
+	var u map[string]interface{}
+	if err := s.Memory.Get(ctx, "u0sim", &u); err != nil {
+		t.Fatal(err)
+	}
+	u["name"] = "Simon L."
+	if _, err := s.Memory.Put(ctx, "u0sim", u); err != nil {
+		t.Fatal(err)
+	}
+	read()
+	if st := d.CacheStats(); st.Misses != 2 || st.Revalidations != 2 || st.Hits != 1 {
+		t.Errorf("got %+v, want a second miss after revalidation", st)
+	}
+}
+
+func TestExpireSessions(t *testing.T) {
+	s := newServer(t)
+	d, err := s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetCircles("u0sim"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rejected request is replayed after logging in again
+	s.ExpireSessions()
+	n := s.Requests()
+	c, err := d.GetCircles("u0sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 2 {
+		t.Errorf("got %d circles, want 2", len(c))
+	}
+	if got := s.Requests() - n; got != 3 { // rejected, login, replayed
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	s := newServer(t)
+	d, err := s.Open(db.WithTimeout(20 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Inject(couchtest.Fault{Path: "_view/circles", Latency: 10 * time.Millisecond})
+	if _, err := d.GetCircles("u0sim"); err != nil {
+		t.Errorf("got %v within the timeout", err)
+	}
+	s.Reset()
+	s.Inject(couchtest.Fault{Latency: time.Second})
+	if _, err := d.GetCircles("u0sim"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	s := newServer(t)
+	d, err := s.Open(
+		db.WithTimeout(20*time.Millisecond),
+		db.WithBreaker(db.BreakerPolicy{Threshold: 2, Cooldown: 50 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Timeouts are failures
+	s.Inject(couchtest.Fault{Latency: time.Second})
+	for i := 0; i < 2; i++ {
+		if _, err := d.GetCircles("u0sim"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want DeadlineExceeded", err)
+		}
+	}
+	if st := d.BreakerState(); st != db.BreakerOpen {
+		t.Fatalf("got %v after timeouts, want open", st)
+	}
+	n := s.Requests()
+	if _, err := d.GetCircles("u0sim"); !errors.Is(err, db.ErrCircuitOpen) {
+		t.Errorf("got %v, want ErrCircuitOpen", err)
+	}
+	if s.Requests() != n {
+		t.Error("request sent while the circuit is open")
+	}
+
+	// A cancelled trial lets another one through
+	time.Sleep(60 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(5*time.Millisecond, cancel)
+	if _, err := d.GetCirclesContext(ctx, "u0sim"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want Canceled", err)
+	}
+	if st := d.BreakerState(); st != db.BreakerHalfOpen {
+		t.Fatalf("got %v after a cancelled trial, want half-open", st)
+	}
+
+	// A successful trial closes the circuit
+	s.Reset()
+	if _, err := d.GetCircles("u0sim"); err != nil {
+		t.Fatal(err)
+	}
+	if st := d.BreakerState(); st != db.BreakerClosed {
+		t.Errorf("got %v after a successful trial, want closed", st)
+	}
+}
@@ -0,0 +1,77 @@
+package couchtest
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A Fault alters the responses of the server to matching requests.
+type Fault struct {
+	Method string // method of the requests affected, or "" for all
+	Path   string // substring of the path of the requests affected, such as "_view/members"
+
+	Latency time.Duration // delay before responding
+	Status  int           // if not zero, status replied instead of serving the request
+	Body    string        // body replied with Status, such as malformed JSON
+	Times   int           // number of requests affected, or 0 for all of them
+}
+
+// Common faults.
+var (
+	ServerError   = Fault{Status: http.StatusInternalServerError, Body: `{"error":"unknown_error","reason":"function_clause"}`}
+	Unauthorized  = Fault{Status: http.StatusUnauthorized, Body: `{"error":"unauthorized","reason":"You are not authorized to access this db."}`}
+	MalformedJSON = Fault{Status: http.StatusOK, Body: `{"rows":[{"id":`}
+)
+
+// Inject adds a fault. Faults are applied in the order in which they were injected;
+// the first one matching a request with a Status decides the response.
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// Reset removes all faults.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// fault applies the faults matching a request and reports whether the response was written.
+func (s *Server) fault(w http.ResponseWriter, r *http.Request) bool {
+	var delay time.Duration
+	var reply *Fault
+	s.mu.Lock()
+	live := s.faults[:0]
+	for _, f := range s.faults {
+		if reply == nil && (f.Method == "" || f.Method == r.Method) && strings.Contains(r.URL.Path, f.Path) {
+			delay += f.Latency
+			if f.Status != 0 {
+				reply = f
+			}
+			if f.Times--; f.Times == 0 {
+				continue // exhausted
+			}
+		}
+		live = append(live, f)
+	}
+	s.faults = live
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return true
+		}
+	}
+	if reply == nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(reply.Status)
+	w.Write([]byte(reply.Body))
+	return true
+}
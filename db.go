@@ -1,149 +1,127 @@
 /*
 Package db implements an interface to the Toople database.
 
-Currently the underlying database is CouchDB but this package abstracts this away.
+Currently the underlying database is CouchDB but this package abstracts this away:
+a DB works on top of any Store, CouchDB being the default one.
 */
 package db
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"net/http"
-	"net/http/cookiejar"
-	"net/url"
-	"strings"
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
 
-	"github.com/simleb/errors"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// db is a string containing the URL of the CouchDB database
+// DB is the Toople database.
 type DB struct {
-	url    string
-	client *http.Client
+	store   Store
+	timeout time.Duration // bound of each operation, if positive
+	metrics *Metrics      // nil if not measured
+	logger  *slog.Logger  // nil if not logging
+	tracer  trace.Tracer
+
+	passwords       PasswordPolicy // rules of new passwords
+	bcryptCost      int            // cost of new password hashes, bcrypt.DefaultCost if below bcrypt.MinCost
+	verificationTTL time.Duration  // validity of verification tokens, if positive
+	resetTTL        time.Duration  // validity of password reset tokens, if positive
+	verifiedOnly    bool           // ignore unverified emails to log in and invite
+
+	resetLatency atomic.Int64 // nanoseconds taken by the last password reset request issuing a token
 }
 
-// New returns an initialized DB object
+// New returns an initialized DB object backed by a CouchDB database.
 func New(host, port, username, password, dbname string) (*DB, error) {
-	jar, _ := cookiejar.New(nil) // err is always nil
-	db := &DB{
-		url:    fmt.Sprintf("http://%s:%s/%s", host, port, dbname),
-		client: &http.Client{Jar: jar},
+	s, err := NewCouchDB(host, port, username, password, dbname)
+	if err != nil {
+		return nil, err
 	}
+	return NewWithStore(s), nil
+}
 
-	// Test connection to database
-	r, err := db.client.Head(fmt.Sprintf("http://%s:%s/", host, port))
+// Open returns an initialized DB object backed by the CouchDB database at a connection URL.
+// See ParseCouchDBURL for the format of the URL.
+func Open(dsn string, opts ...Option) (*DB, error) {
+	c, err := ParseCouchDBURL(dsn)
 	if err != nil {
-		return nil, fmt.Errorf("db: %s:%s: connection refused", host, port)
+		return nil, err
 	}
-	if !strings.HasPrefix(r.Header.Get("Server"), "CouchDB") {
-		return nil, fmt.Errorf("db: %s:%s is not CouchDB", host, port)
+	o := options{couch: c}
+	for _, opt := range opts {
+		opt(&o)
 	}
-	switch r.StatusCode {
-	case 200:
-	default:
-		return nil, fmt.Errorf("db: %s:%s: status %d", host, port, r.StatusCode)
-	}
-
-	// Authenticate
-	s := fmt.Sprintf("http://%s:%s/_session", host, port)
-	p := fmt.Sprintf("name=%s&password=%s", url.QueryEscape(username), url.QueryEscape(password))
-	r, err = db.client.Post(s, "application/x-www-form-urlencoded", strings.NewReader(p))
+	s, err := DialCouchDB(o.couch)
 	if err != nil {
-		return nil, fmt.Errorf("db: %s:%s: connection refused", host, port)
-	}
-	defer r.Body.Close()
-	switch r.StatusCode {
-	case 200:
-	case 401:
-		return nil, fmt.Errorf("db: %s:%s: unauthorized", host, port)
-	default:
-		return nil, fmt.Errorf("db: %s:%s: status %d", host, port, r.StatusCode)
+		return nil, err
 	}
+	return o.db(s), nil
+}
 
-	// Check role (read/write access)
-	var v struct{ Roles []string }
-	d := json.NewDecoder(r.Body)
-	if err = d.Decode(&v); err != nil {
-		return nil, fmt.Errorf("db: %s:%s: bad JSON in database response", host, port)
-	}
-	for _, role := range v.Roles {
-		if role == "db" {
-			return db, nil
-		}
+// NewWithStore returns a DB object backed by an arbitrary store.
+// Options only concerning CouchDB are ignored.
+func NewWithStore(s Store, opts ...Option) *DB {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
 	}
-	return nil, fmt.Errorf("db: %s:%s: read or write permission denied", host, port)
+	return o.db(s)
 }
 
-// view gives the URL of a view including queries for a key and if docs should be returned
-func (db *DB) view(view, key string, include_docs bool) string {
-	return fmt.Sprintf(`_design/toople/_view/%s?key="%s"&include_docs=%t`, view, url.QueryEscape(key), include_docs)
+// CacheStats returns the statistics of the read cache, which are zero without one (see WithCache).
+func (db *DB) CacheStats() CacheStats {
+	if c, ok := db.store.(*cache); ok {
+		return c.Stats()
+	}
+	return CacheStats{}
 }
 
-// view gives the URL of a view including queries for a key and if docs should be returned
-func (db *DB) dateView(view, key string, include_docs bool) string {
-	return fmt.Sprintf(`_design/toople/_view/%s?startkey=["%s"]&endkey=["%[2]s",{}]`+
-		`&include_docs=%t`, view, url.QueryEscape(key), include_docs)
+// FollowChanges keeps the read cache in sync with the changes feed of the database
+// until ctx is done or an error occurs, which it returns.
+// Meanwhile cached documents are served without revalidation, at the risk of being
+// slightly out of date. It is typically run in its own goroutine.
+func (db *DB) FollowChanges(ctx context.Context) error {
+	c, ok := db.store.(*cache)
+	if !ok {
+		return errors.New("follow changes: no cache (see WithCache)")
+	}
+	return c.follow(withOp(ctx, "follow changes"))
 }
 
-// request performs an http request against the database
-func (db *DB) request(method, path string, in, out interface{}) (int, error) {
-	body := new(bytes.Buffer)
-
-	// Encode JSON
-	if in != nil {
-		d := json.NewEncoder(body)
-		if err := d.Encode(in); err != nil {
-			return http.StatusInternalServerError, errors.Stack(err, "request: error encoding JSON")
-		}
+// operation returns ctx carrying the name of an operation for logs and metrics,
+// as well as its span, child of the span of ctx if any.
+// The operation must be ended by calling end with a pointer to its error.
+func (db *DB) operation(ctx context.Context, op string) (_ context.Context, end func(*error)) {
+	ctx, span := db.tracer.Start(withOp(ctx, op), op)
+	return ctx, func(err *error) {
+		db.metrics.operation(op, *err)
+		endSpan(span, *err)
 	}
+}
 
-	// Request
-	req, err := http.NewRequest(method, db.url+"/"+path, body)
-	if err != nil {
-		return http.StatusInternalServerError, errors.Stack(err, "request: error creating HTTP request")
+// context is like operation but also bounds ctx by the operation timeout of the DB, if any.
+func (db *DB) context(ctx context.Context, op string) (_ context.Context, end func(*error)) {
+	ctx, done := db.operation(ctx, op)
+	var cancel context.CancelFunc
+	if db.timeout <= 0 {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(ctx, db.timeout)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	res, err := db.client.Do(req)
-	if err != nil {
-		return http.StatusInternalServerError, errors.Stack(err, "request: error sending HTTP request")
+	return ctx, func(err *error) {
+		cancel()
+		done(err)
 	}
-	defer res.Body.Close()
-
-	// Decode JSON
-	if out != nil {
-		d := json.NewDecoder(res.Body)
-		if err := d.Decode(out); err != nil {
-			return res.StatusCode, errors.Stack(err, "request: error decoding JSON")
-		}
-	}
-
-	return res.StatusCode, nil
-}
-
-// rev returns the current revision of a document if it was found
-func (db *DB) rev(id string) (string, error) {
-	res, err := http.Head(db.url + "/" + id)
-	return res.Header.Get("ETag"), errors.Stack(err, "rev: error during HEAD request")
-}
-
-// get performs a get request against the database
-func (db *DB) get(path string, out interface{}) (int, error) {
-	return db.request("GET", path, nil, out)
-}
-
-// post performs a post request against the database
-func (db *DB) post(path string, in, out interface{}) (int, error) {
-	return db.request("POST", path, in, out)
 }
 
-// put performs a put request against the database
-func (db *DB) put(path string, in interface{}) (int, error) {
-	return db.request("PUT", path, in, nil)
-}
-
-// delete performs a delete request against the database
-func (db *DB) delete(id, rev string) (int, error) {
-	return db.request("DELETE", fmt.Sprintf("%s?rev=%s", id, rev), nil, nil)
+// BreakerState returns the state of the circuit breaker of the store,
+// which is always closed for stores without one.
+// It allows callers to degrade gracefully while the database is down.
+func (db *DB) BreakerState() BreakerState {
+	if b, ok := db.store.(interface{ BreakerState() BreakerState }); ok {
+		return b.BreakerState()
+	}
+	return BreakerClosed
 }
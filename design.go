@@ -0,0 +1,169 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// views holds the sources of the views of the toople design document.
+//
+//go:embed couchdb/views
+var views embed.FS
+
+// designId is the id of the toople design document.
+const designId = "_design/toople"
+
+// ErrDesignOutdated is returned when the deployed design document differs from the embedded one.
+var ErrDesignOutdated = errors.New("design document outdated")
+
+// A design is a CouchDB design document.
+type design struct {
+	Id       string                `json:"_id"`
+	Rev      string                `json:"_rev,omitempty"`
+	Language string                `json:"language"`
+	Views    map[string]designView `json:"views"`
+}
+
+// A designView is a view of a design document.
+type designView struct {
+	Map    string `json:"map"`
+	Reduce string `json:"reduce,omitempty"`
+}
+
+// A DesignPolicy tells what to do with the deployed design document on startup.
+type DesignPolicy int
+
+const (
+	DesignIgnore DesignPolicy = iota // do nothing
+	DesignVerify                     // fail with ErrDesignOutdated if it differs from the embedded one
+	DesignUpdate                     // update it if it differs from the embedded one
+	DesignWait                       // update it and wait for the view indexes to be built
+)
+
+// newDesign builds the toople design document from the embedded sources in couchdb/views.
+func newDesign() (*design, error) {
+	d := &design{
+		Id:       designId,
+		Language: "javascript",
+		Views:    make(map[string]designView),
+	}
+	dirs, err := fs.ReadDir(views, "couchdb/views")
+	if err != nil {
+		return nil, stack(err, "design: cannot list views")
+	}
+	for _, dir := range dirs {
+		var v designView
+		for name, src := range map[string]*string{"map.js": &v.Map, "reduce.js": &v.Reduce} {
+			b, err := fs.ReadFile(views, path.Join("couchdb/views", dir.Name(), name))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, stack(err, "design: cannot read %s view", dir.Name())
+			}
+			*src = strings.TrimSpace(string(b))
+		}
+		d.Views[dir.Name()] = v
+	}
+	return d, nil
+}
+
+// equal reports whether two design documents have the same views.
+// Leading and trailing spaces of the sources are not significant.
+func (d *design) equal(e *design) bool {
+	if d.Language != e.Language || len(d.Views) != len(e.Views) {
+		return false
+	}
+	for name, v := range d.Views {
+		w, ok := e.Views[name]
+		if !ok || v.Map != strings.TrimSpace(w.Map) || v.Reduce != strings.TrimSpace(w.Reduce) {
+			return false
+		}
+	}
+	return true
+}
+
+// SyncDesign compares the deployed toople design document with the one embedded
+// in the package and updates it if they differ. It reports whether it was updated.
+// If wait is true, it then waits for the view indexes to be built.
+func (db *DB) SyncDesign(wait bool) (bool, error) {
+	return db.SyncDesignContext(context.Background(), wait)
+}
+
+// SyncDesignContext is like SyncDesign but passes ctx down to every database request.
+func (db *DB) SyncDesignContext(ctx context.Context, wait bool) (_ bool, err error) {
+	ctx, end := db.operation(ctx, "sync design")
+	defer end(&err)
+	return syncDesign(ctx, db.store, DesignUpdate, wait)
+}
+
+// VerifyDesign returns an ErrDesignOutdated error if the deployed toople design document
+// differs from the one embedded in the package.
+func (db *DB) VerifyDesign() error {
+	return db.VerifyDesignContext(context.Background())
+}
+
+// VerifyDesignContext is like VerifyDesign but passes ctx down to every database request.
+func (db *DB) VerifyDesignContext(ctx context.Context) (err error) {
+	ctx, end := db.operation(ctx, "verify design")
+	defer end(&err)
+	_, err = syncDesign(ctx, db.store, DesignVerify, false)
+	return err
+}
+
+// syncDesign applies a design policy to a store and reports whether the design document was updated.
+// Only the views and language of the deployed document are replaced: its other fields,
+// such as validate_doc_update, are kept.
+func syncDesign(ctx context.Context, s Store, p DesignPolicy, wait bool) (bool, error) {
+	if p == DesignIgnore {
+		return false, nil
+	}
+	d, err := newDesign()
+	if err != nil {
+		return false, err
+	}
+
+	// Compare with deployed design document
+	var deployed map[string]interface{}
+	err = s.Get(ctx, designId, &deployed)
+	switch {
+	case err == nil:
+		var old design
+		if err := fromMap(deployed, &old); err != nil {
+			return false, stack(err, "design: bad deployed design document")
+		}
+		if d.equal(&old) {
+			return false, waitViews(ctx, s, d, wait)
+		}
+	case errors.Is(err, ErrNotFound):
+		deployed = map[string]interface{}{"_id": designId}
+	default:
+		return false, stack(err, "design: cannot get deployed design document")
+	}
+	if p == DesignVerify {
+		return false, stack(ErrDesignOutdated, "design")
+	}
+
+	// Update it
+	deployed["language"], deployed["views"] = d.Language, d.Views
+	if _, err := s.Put(ctx, designId, deployed); err != nil {
+		return false, stack(err, "design: cannot update design document")
+	}
+	return true, waitViews(ctx, s, d, wait)
+}
+
+// waitViews waits for the indexes of the views of a design document to be built,
+// which happens when they are queried.
+func waitViews(ctx context.Context, s Store, d *design, wait bool) error {
+	if !wait {
+		return nil
+	}
+	for name := range d.Views {
+		var v struct{ Rows []struct{} }
+		if err := s.Query(ctx, View(name), "", false, &v); err != nil {
+			return stack(err, "design: error building %s view", name)
+		}
+	}
+	return nil
+}
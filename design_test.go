@@ -0,0 +1,47 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSyncDesignMerge(t *testing.T) {
+	db, m := fixtureDB(t)
+	ctx := context.Background()
+	deployed := map[string]interface{}{
+		"language":            "javascript",
+		"views":               map[string]interface{}{"old": map[string]string{"map": "function(doc) {}"}},
+		"validate_doc_update": "function(newDoc, oldDoc, userCtx) {}",
+		"couchapp":            map[string]interface{}{"name": "toople"},
+	}
+	if _, err := m.Put(ctx, designId, deployed); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.VerifyDesignContext(ctx); !errors.Is(err, ErrDesignOutdated) {
+		t.Fatalf("got %v, want ErrDesignOutdated", err)
+	}
+
+	updated, err := db.SyncDesign(false)
+	if err != nil || !updated {
+		t.Fatalf("got %v, %v, want an update", updated, err)
+	}
+	if err := db.VerifyDesign(); err != nil {
+		t.Errorf("after an update: %v", err)
+	}
+	var got map[string]interface{}
+	if err := m.Get(ctx, designId, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["validate_doc_update"] != deployed["validate_doc_update"] || got["couchapp"] == nil {
+		t.Errorf("got %v, want the other fields of the deployed document kept", got)
+	}
+	if views, _ := got["views"].(map[string]interface{}); views["old"] != nil || views[string(ViewEmail)] == nil {
+		t.Errorf("got views %v, want the embedded ones", views)
+	}
+
+	// Nothing to do the next time
+	if updated, err := db.SyncDesign(false); err != nil || updated {
+		t.Errorf("got %v, %v, want no update", updated, err)
+	}
+}
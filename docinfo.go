@@ -0,0 +1,40 @@
+package db
+
+import "context"
+
+// DocInfo returns the metadata of a document.
+// It returns an ErrNotFound error if the document does not exist or was deleted,
+// along with whatever metadata is known.
+func (db *DB) DocInfo(id string) (DocInfo, error) {
+	return db.DocInfoContext(context.Background(), id)
+}
+
+// DocInfoContext is like DocInfo but passes ctx down to every database request.
+func (db *DB) DocInfoContext(ctx context.Context, id string) (_ DocInfo, err error) {
+	ctx, end := db.context(ctx, "doc info")
+	defer end(&err)
+
+	infos, err := db.store.Infos(ctx, []string{id})
+	if err != nil {
+		return DocInfo{Id: id}, stack(err, "doc info: database error")
+	}
+	if !infos[0].Exists() {
+		return infos[0], stack(ErrNotFound, "doc info: %q", id)
+	}
+	return infos[0], nil
+}
+
+// DocInfos returns the metadata of documents, in the order of ids, in a single round trip.
+// Unlike DocInfo, it does not fail on missing documents: use DocInfo.Exists.
+func (db *DB) DocInfos(ids []string) ([]DocInfo, error) {
+	return db.DocInfosContext(context.Background(), ids)
+}
+
+// DocInfosContext is like DocInfos but passes ctx down to every database request.
+func (db *DB) DocInfosContext(ctx context.Context, ids []string) (_ []DocInfo, err error) {
+	ctx, end := db.context(ctx, "doc infos")
+	defer end(&err)
+
+	infos, err := db.store.Infos(ctx, ids)
+	return infos, stack(err, "doc infos: database error")
+}
@@ -0,0 +1,249 @@
+package db
+
+import (
+	"context"
+	"errors"
+)
+
+// AddEmail adds an email address to a user. The address must not belong to another user.
+// Adding an address the user already has does nothing.
+// New addresses are not verified (see IssueVerification).
+func (db *DB) AddEmail(userId, email string) error {
+	return db.AddEmailContext(context.Background(), userId, email)
+}
+
+// AddEmailContext is like AddEmail but passes ctx down to every database request.
+func (db *DB) AddEmailContext(ctx context.Context, userId, email string) (err error) {
+	ctx, end := db.context(ctx, "add email")
+	defer end(&err)
+
+	email = normalizeEmail(email)
+	if err := validateEmail(email); err != nil {
+		return stack(err, "add email: bad email")
+	}
+
+	// Check if email is available
+	owner, err := db.emailOwner(ctx, email)
+	if err != nil {
+		return stack(err, "add email")
+	}
+	if owner != "" && owner != userId {
+		return stack(ErrEmailTaken, "add email")
+	}
+
+	// Claim the email, which fails if another user claimed it meanwhile
+	u := db.begin(ctx)
+	if owner == "" {
+		if err := u.claimEmail(email, userId); err != nil {
+			return stack(err, "add email")
+		}
+	}
+	_, err = db.updateUser(ctx, userId, func(d *user) bool {
+		if contains(d.Emails, email) {
+			return false
+		}
+		d.Emails = append(d.Emails, email)
+		return true
+	})
+	if err != nil {
+		return u.abort(stack(err, "add email: cannot update user"))
+	}
+	return nil
+}
+
+// RemoveEmail removes an email address from a user.
+// The last address of a user cannot be removed.
+// If the primary address is removed, the next one becomes primary.
+// The outstanding tokens sent to the address, such as password resets, are revoked.
+func (db *DB) RemoveEmail(userId, email string) error {
+	return db.RemoveEmailContext(context.Background(), userId, email)
+}
+
+// RemoveEmailContext is like RemoveEmail but passes ctx down to every database request.
+func (db *DB) RemoveEmailContext(ctx context.Context, userId, email string) (err error) {
+	ctx, end := db.context(ctx, "remove email")
+	defer end(&err)
+
+	email = normalizeEmail(email)
+	var cause error
+	u, err := db.updateUser(ctx, userId, func(u *user) bool {
+		switch {
+		case !contains(u.Emails, email):
+			cause = stack(ErrNotFound, "email %q", email)
+		case len(u.Emails) == 1:
+			cause = invalid("email", "is the only address of the user")
+		default:
+			cause = nil
+			delete(u.Verified, email)
+			return remove(&u.Emails, email)
+		}
+		return false
+	})
+	if err != nil {
+		return stack(err, "remove email: cannot update user")
+	}
+
+	// Release the email and revoke its tokens, even if it was removed earlier by an interrupted call
+	if !contains(u.Emails, email) {
+		if err := db.releaseEmail(ctx, email, userId); err != nil {
+			return stack(err, "remove email")
+		}
+		if err := db.revokeTokens(ctx, userId, func(t *token) bool { return t.Email == email }); err != nil {
+			return stack(err, "remove email: cannot revoke tokens")
+		}
+	}
+	return stack(cause, "remove email")
+}
+
+// SetPrimaryEmail makes one of the email addresses of a user the primary one.
+func (db *DB) SetPrimaryEmail(userId, email string) error {
+	return db.SetPrimaryEmailContext(context.Background(), userId, email)
+}
+
+// SetPrimaryEmailContext is like SetPrimaryEmail but passes ctx down to every database request.
+func (db *DB) SetPrimaryEmailContext(ctx context.Context, userId, email string) (err error) {
+	ctx, end := db.context(ctx, "set primary email")
+	defer end(&err)
+
+	email = normalizeEmail(email)
+	owner, err := db.emailOwner(ctx, email)
+	if err != nil {
+		return stack(err, "set primary email")
+	}
+	if owner != userId {
+		return stack(ErrNotFound, "set primary email: email %q of user %q", email, userId)
+	}
+
+	var found bool
+	_, err = db.updateUser(ctx, userId, func(u *user) bool {
+		found = contains(u.Emails, email)
+		if !found || u.Emails[0] == email {
+			return false
+		}
+		remove(&u.Emails, email)
+		u.Emails = append([]string{email}, u.Emails...)
+		return true
+	})
+	if err != nil {
+		return stack(err, "set primary email: cannot update user")
+	}
+	if !found {
+		return stack(ErrNotFound, "set primary email: email %q of user %q", email, userId)
+	}
+	return nil
+}
+
+// An emailClaim is a CouchDB document reserving an email address for a user.
+// Its id is made of the address, so that CouchDB rejects a second claim with a conflict.
+// Addresses of users registered before claims existed have none: the email view finds them.
+type emailClaim struct {
+	Id   string `json:"_id"`
+	Rev  string `json:"_rev,omitempty"`
+	Type string `json:"type"`
+	User string `json:"user"`
+}
+
+// claimId returns the id of the claim document of an email.
+func claimId(email string) string {
+	return "email:" + email
+}
+
+// claimEmail claims an email for a user within the unit of work.
+// It fails with ErrEmailTaken if the email is already claimed.
+func (u *unit) claimEmail(email, userId string) error {
+	c := emailClaim{Id: claimId(email), Type: "email", User: userId}
+	_, err := u.create(&c)
+	if errors.Is(err, ErrConflict) {
+		return ErrEmailTaken
+	}
+	return stack(err, "cannot claim email")
+}
+
+// emailOwner returns the id of the user owning an email, or "" if there is none.
+// Addresses without a claim (see emailClaim) are looked up in the email view.
+func (db *DB) emailOwner(ctx context.Context, email string) (string, error) {
+	var c emailClaim
+	err := db.store.Get(ctx, claimId(email), &c)
+	if err == nil {
+		return c.User, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return "", stack(err, "cannot get email claim")
+	}
+	var v struct{ Rows []struct{ Id string } }
+	if err := db.store.Query(ctx, ViewEmail, email, false, &v); err != nil {
+		return "", stack(err, "error querying email view")
+	}
+	if len(v.Rows) == 0 {
+		return "", nil
+	}
+	return v.Rows[0].Id, nil
+}
+
+// releaseEmail deletes the claim of an email by a user, if any.
+func (db *DB) releaseEmail(ctx context.Context, email, userId string) error {
+	var c emailClaim
+	err := db.store.Get(ctx, claimId(email), &c)
+	if errors.Is(err, ErrNotFound) || err == nil && c.User != userId {
+		return nil
+	}
+	if err != nil {
+		return stack(err, "cannot get email claim")
+	}
+	if err := db.store.Delete(ctx, c.Id, c.Rev); err != nil && !errors.Is(err, ErrNotFound) {
+		return stack(err, "cannot delete email claim")
+	}
+	return nil
+}
+
+// maxUpdates is the number of times an update is attempted
+// when the document keeps being updated concurrently.
+const maxUpdates = 3
+
+// updateUser applies fn to the document of a user and saves it, unless fn reports no change.
+// If the document is updated meanwhile, fn is applied again to the new version.
+// It returns the saved document.
+func (db *DB) updateUser(ctx context.Context, id string, fn func(u *user) bool) (*user, error) {
+	for n := 1; ; n++ {
+		var u user
+		if err := db.store.Get(ctx, id, &u); err != nil {
+			return nil, err
+		}
+		if u.Type != "user" {
+			return nil, stack(ErrNotFound, "user %q", id)
+		}
+		if !fn(&u) {
+			return &u, nil
+		}
+		rev, err := db.store.Put(ctx, id, &u)
+		if errors.Is(err, ErrConflict) && n < maxUpdates {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		u.Rev = rev
+		return &u, nil
+	}
+}
+
+// contains reports whether s contains v.
+func contains(s []string, v string) bool {
+	for _, w := range s {
+		if w == v {
+			return true
+		}
+	}
+	return false
+}
+
+// remove removes v from *s and reports whether it was there.
+func remove(s *[]string, v string) bool {
+	for i, w := range *s {
+		if w == v {
+			*s = append((*s)[:i:i], (*s)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestAddEmail(t *testing.T) {
+	db, _ := fixtureDB(t)
+	a, err := db.NewUser("Ann", "ann@example.com", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.NewUser("Ben", "ben@example.com", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.AddEmail(a.Id, "ben@example.com"); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("got %v, want ErrEmailTaken", err)
+	}
+	if err := db.AddEmail(a.Id, "kus@gmail.com"); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("address of the fixtures: got %v, want ErrEmailTaken", err)
+	}
+
+	// Concurrent additions of the same address
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, id := range []string{a.Id, b.Id} {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			errs[i] = db.AddEmail(id, "team@example.com")
+		}(i, id)
+	}
+	wg.Wait()
+	if (errs[0] == nil) == (errs[1] == nil) {
+		t.Fatalf("got %v, want a single success", errs)
+	}
+	if ids := viewIds(t, db.store, ViewEmail, "team@example.com"); len(ids) != 1 {
+		t.Errorf("got users %v for the address, want 1", ids)
+	}
+
+	// Removed addresses are available again
+	owner, other := a.Id, b.Id
+	if errs[0] != nil {
+		owner, other = other, owner
+	}
+	if err := db.RemoveEmail(owner, "team@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddEmail(other, "team@example.com"); err != nil {
+		t.Errorf("got %v after removal", err)
+	}
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Errors returned by the package, to be tested with errors.Is.
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrInvalid      = errors.New("invalid")
+
+	// ErrEmailTaken and ErrSlugTaken are conflicts (errors.Is(err, ErrConflict) holds).
+	ErrEmailTaken error = conflictError("email not available")
+	ErrSlugTaken  error = conflictError("slug is not unique")
+)
+
+// A conflictError is a specific kind of ErrConflict.
+type conflictError string
+
+func (e conflictError) Error() string        { return string(e) }
+func (e conflictError) Is(target error) bool { return target == ErrConflict }
+
+// A ValidationError reports an invalid argument.
+// It is an ErrInvalid (errors.Is(err, ErrInvalid) holds).
+type ValidationError struct {
+	Field string // name of the field, such as "email"
+	Msg   string // what is wrong with it, such as "@ missing"
+}
+
+func (e *ValidationError) Error() string        { return e.Field + " " + e.Msg }
+func (e *ValidationError) Is(target error) bool { return target == ErrInvalid }
+
+// invalid returns a ValidationError.
+func invalid(field, format string, args ...interface{}) error {
+	return &ValidationError{Field: field, Msg: fmt.Sprintf(format, args...)}
+}
+
+// A BackendError reports an unexpected status code from the database server.
+// It is an ErrNotFound, ErrConflict, ErrUnauthorized or ErrForbidden
+// if the status code is 404, 409, 401 or 403 respectively.
+type BackendError struct {
+	Op     string // operation, such as `get "u0sim"` or "members view"
+	Status int    // HTTP status code
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("couchdb: %s: status %d", e.Op, e.Status)
+}
+
+func (e *BackendError) Is(target error) bool {
+	switch e.Status {
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	}
+	return false
+}
+
+// stack annotates err with a message in the manner of github.com/simleb/errors.Stack,
+// but keeps err inspectable with errors.Is and errors.As.
+// It returns nil if err is nil.
+func stack(err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), err)
+}
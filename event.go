@@ -1,11 +1,8 @@
 package db
 
 import (
-	"fmt"
-	"net/http"
+	"context"
 	"time"
-
-	"github.com/simleb/errors"
 )
 
 // An Event is a proxy for a full event document in the database.
@@ -64,94 +61,82 @@ type invitation struct {
 // a creator (who will be the first participant), the list of invited circles
 // and the number of participants required for the event to take place.
 func (db *DB) NewEvent(date time.Time, loc, title, info, creator string, thresh int, circles []string) error {
+	return db.NewEventContext(context.Background(), date, loc, title, info, creator, thresh, circles)
+}
+
+// NewEventContext is like NewEvent but passes ctx down to every database request.
+func (db *DB) NewEventContext(ctx context.Context, date time.Time, loc, title, info, creator string, thresh int, circles []string) (err error) {
+	ctx, end := db.context(ctx, "new event")
+	defer end(&err)
+
 	// Sanity checks
 	if date.Before(time.Now()) {
-		return fmt.Errorf("new event: event must take place in the future")
+		return stack(invalid("date", "must be in the future"), "new event")
 	}
 	if loc == "" {
-		return fmt.Errorf("new event: location is required")
+		return stack(invalid("location", "is required"), "new event")
 	}
 	if title == "" {
-		return fmt.Errorf("new event: title is required")
+		return stack(invalid("title", "is required"), "new event")
 	}
 	if creator == "" {
-		return fmt.Errorf("new event: creator is required")
+		return stack(invalid("creator", "is required"), "new event")
 	}
 	if thresh < 1 {
-		return fmt.Errorf("new event: threshold must be strictly positive")
+		return stack(invalid("threshold", "must be strictly positive"), "new event")
 	}
 	if len(circles) == 0 {
-		return fmt.Errorf("new event: must invite at least one circle")
+		return stack(invalid("circles", "must contain at least one circle"), "new event")
 	}
 
-	// Check if creator exists
-	rev, err := db.rev(creator)
+	// Check that creator and all circles exist, in a single request
+	infos, err := db.store.Infos(ctx, append([]string{creator}, circles...))
 	if err != nil {
-		return errors.Stack(err, "new event: cannot check if user %q exists", creator)
+		return stack(err, "new event: cannot check if user and circles exist")
 	}
-	if rev == "" {
-		return fmt.Errorf("new event: user %q does not exist", creator)
-	}
-
-	// Check that all circles exist
-	for _, c := range circles {
-		rev, err := db.rev(c)
-		if err != nil {
-			return errors.Stack(err, "new event: cannot check if circle %q exists", c)
+	for i, info := range infos {
+		t := "circle"
+		if i == 0 {
+			t = "user"
 		}
-		if rev == "" {
-			return fmt.Errorf("new event: circle %q does not exist", c)
+		if !info.Exists() || info.Type != t {
+			return stack(ErrNotFound, "new event: %s %q", t, info.Id)
 		}
-
 	}
 
-	// Create event document in database
-	e := event{
+	// Event document, with an id chosen here so that other documents can refer to it
+	id := uuid()
+	docs := []interface{}{&event{
+		Id:        id,
 		Type:      "event",
 		Title:     title,
 		Info:      info,
 		Date:      date,
 		Location:  loc,
 		Threshold: thresh,
-	}
-	var r struct{ Id string }
-	s, err := db.post("", &e, &r)
-	if err != nil {
-		return errors.Stack(err, "new event: cannot create event")
-	}
-	if s != http.StatusCreated {
-		return fmt.Errorf("new event: got status %d trying to create event", s)
-	}
+	}}
 
-	// Create participant document in database
-	p := participant{
+	// Participant document
+	docs = append(docs, &participant{
 		Type:  "participant",
 		User:  creator,
-		Event: r.Id,
+		Event: id,
 		Date:  date,
-	}
-	s, err = db.post("", &p, nil)
-	if err != nil {
-		return errors.Stack(err, "new event: cannot create participant")
-	}
-	if s != http.StatusCreated {
-		return fmt.Errorf("new event: got status %d trying to create participant", s)
-	}
+	})
 
-	// Create invitation documents in database
+	// Invitation documents
 	for _, c := range circles {
-		i := invitation{
+		docs = append(docs, &invitation{
 			Type:   "invitation",
 			Circle: c,
-			Event:  r.Id,
-		}
-		s, err = db.post("", &i, nil)
-		if err != nil {
-			return errors.Stack(err, "new event: cannot create invitation")
-		}
-		if s != http.StatusCreated {
-			return fmt.Errorf("new event: got status %d trying to create invitation", s)
-		}
+			Event:  id,
+		})
+	}
+
+	// Create all documents at once
+	u := db.begin(ctx)
+	if err := u.createAll(docs); err != nil {
+		return u.abort(stack(err, "new event: cannot create event"))
 	}
 	return nil
 }
@@ -164,7 +149,16 @@ func (e *Event) PrettyDate() string {
 	return e.Date.Format("Mon Jan 2 — 3:04pm")
 }
 
+// JoinEvent adds a user to the participants of an event, unless already participating.
 func (db *DB) JoinEvent(event, user string) error {
+	return db.JoinEventContext(context.Background(), event, user)
+}
+
+// JoinEventContext is like JoinEvent but passes ctx down to every database request.
+func (db *DB) JoinEventContext(ctx context.Context, event, user string) (err error) {
+	ctx, end := db.context(ctx, "join event")
+	defer end(&err)
+
 	// Check if not already participant
 	var v struct {
 		Rows []struct {
@@ -173,12 +167,8 @@ func (db *DB) JoinEvent(event, user string) error {
 			}
 		}
 	}
-	s, err := db.get(db.view("participants", event, false), &v)
-	if err != nil {
-		return errors.Stack(err, "join event: error querying participants view")
-	}
-	if s != http.StatusOK {
-		return fmt.Errorf("join event: database error")
+	if err := db.store.Query(ctx, ViewParticipants, event, false, &v); err != nil {
+		return stack(err, "join event: error querying participants view")
 	}
 	for _, r := range v.Rows {
 		if r.Value.User == user {
@@ -192,12 +182,8 @@ func (db *DB) JoinEvent(event, user string) error {
 		Event: event,
 		Date:  time.Now(),
 	}
-	s, err = db.post("", &p, nil)
-	if err != nil {
-		return errors.Stack(err, "join event: database error")
-	}
-	if s != http.StatusCreated {
-		return fmt.Errorf("join event: got status %d trying to create event", s)
+	if _, _, err := db.store.Create(ctx, &p); err != nil {
+		return stack(err, "join event: database error")
 	}
 	return nil
 }
@@ -0,0 +1,25 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewEventRollback(t *testing.T) {
+	db, m := fixtureDB(t)
+	n := docCount(t, m)
+
+	// The event and its participant are written, the invitations are not
+	db.store = failingType{m, "invitation"}
+	err := db.NewEvent(time.Now().Add(time.Hour), "Pool", "Swim", "", "u0sim", 2, []string{"c0kus", "c0clab"})
+	if !errors.Is(err, errCreate) {
+		t.Fatalf("got %v, want the failure of the invitations", err)
+	}
+	if got := docCount(t, m); got != n {
+		t.Errorf("got %d documents, want the %d before", got, n)
+	}
+	if _, err := db.GetNotifications("u0sim"); err != nil {
+		t.Errorf("notifications after a rollback: %v", err)
+	}
+}
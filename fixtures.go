@@ -0,0 +1,199 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// readFixtures reads the documents of a fixture directory such as couchdb/_docs,
+// which holds one JSON file per document, in file name order.
+// Documents without _id take the one their file is named after (see fixtureFile).
+func readFixtures(dir string) ([]map[string]interface{}, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, stack(err, "cannot list fixtures in %q", dir)
+	}
+	docs := make([]map[string]interface{}, len(files))
+	for i, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, stack(err, "cannot read fixture %q", f)
+		}
+		if err := json.Unmarshal(b, &docs[i]); err != nil {
+			return nil, stack(err, "bad JSON in fixture %q", f)
+		}
+		if id, _ := docs[i]["_id"].(string); id == "" {
+			id, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(f), ".json"))
+			if err != nil {
+				return nil, fmt.Errorf("fixture %q has no _id", f)
+			}
+			docs[i]["_id"] = id
+		}
+		delete(docs[i], "_rev")
+	}
+	return docs, nil
+}
+
+// LoadFixtures seeds the database with the documents of a fixture directory
+// such as couchdb/_docs, and returns the number of documents written.
+// Documents already in the database are left alone, unless replace is true,
+// in which case they are overwritten.
+func (db *DB) LoadFixtures(dir string, replace bool) (int, error) {
+	return db.LoadFixturesContext(context.Background(), dir, replace)
+}
+
+// LoadFixturesContext is like LoadFixtures but passes ctx down to every database request.
+func (db *DB) LoadFixturesContext(ctx context.Context, dir string, replace bool) (_ int, err error) {
+	ctx, end := db.operation(ctx, "load fixtures")
+	defer end(&err)
+
+	docs, err := readFixtures(dir)
+	if err != nil {
+		return 0, stack(err, "load fixtures")
+	}
+	ids := make([]string, len(docs))
+	for i, d := range docs {
+		ids[i] = d["_id"].(string)
+	}
+	infos, err := db.store.Infos(ctx, ids)
+	if err != nil {
+		return 0, stack(err, "load fixtures: database error")
+	}
+	n := 0
+	for i, d := range docs {
+		if infos[i].Exists() {
+			if !replace {
+				continue
+			}
+			d["_rev"] = infos[i].Rev
+		}
+		if _, err := db.store.Put(ctx, ids[i], d); err != nil {
+			return n, stack(err, "load fixtures: cannot write %q", ids[i])
+		}
+		n++
+	}
+	return n, nil
+}
+
+// DumpFixtures writes the documents of the database to a directory, one file per document
+// named after its escaped id, in the layout of couchdb/_docs, and returns the number of documents written.
+// If circle is not empty, only the documents related to that circle are written:
+// the circle, its members and invitations, their users and events,
+// the participants of those events and the dismiss and email claim documents of those users.
+func (db *DB) DumpFixtures(dir, circle string) (int, error) {
+	return db.DumpFixturesContext(context.Background(), dir, circle)
+}
+
+// DumpFixturesContext is like DumpFixtures but passes ctx down to every database request.
+func (db *DB) DumpFixturesContext(ctx context.Context, dir, circle string) (_ int, err error) {
+	ctx, end := db.operation(ctx, "dump fixtures")
+	defer end(&err)
+
+	docs := make(map[string]map[string]interface{})
+	err = db.store.Scan(ctx, "", func(d map[string]interface{}) error {
+		delete(d, "_rev")
+		docs[d["_id"].(string)] = d
+		return nil
+	})
+	if err != nil {
+		return 0, stack(err, "dump fixtures: database error")
+	}
+	if circle != "" {
+		if _, ok := docs[circle]; !ok {
+			return 0, stack(ErrNotFound, "dump fixtures: circle %q", circle)
+		}
+		docs = circleDocs(docs, circle)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, stack(err, "dump fixtures: cannot create %q", dir)
+	}
+	ids := make([]string, 0, len(docs))
+	for id := range docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for i, id := range ids {
+		b, err := json.MarshalIndent(docs[id], "", "\t")
+		if err != nil {
+			return i, stack(err, "dump fixtures: cannot encode %q", id)
+		}
+		f := filepath.Join(dir, fixtureFile(id))
+		if err := os.WriteFile(f, append(b, '\n'), 0644); err != nil {
+			return i, stack(err, "dump fixtures: cannot write %q", f)
+		}
+	}
+	return len(ids), nil
+}
+
+// fixtureFile returns the name of the fixture file of a document.
+// Ids are escaped since not all of them are valid file names:
+// an id containing "/", such as the claim "email:<addr>" of an address like "a/b@example.com",
+// would name a file in a subdirectory, and one containing "%" would not unescape back.
+func fixtureFile(id string) string {
+	return url.PathEscape(id) + ".json"
+}
+
+// circleDocs returns the subset of docs related to a circle (see DumpFixtures).
+func circleDocs(docs map[string]map[string]interface{}, circle string) map[string]map[string]interface{} {
+	keep := map[string]bool{circle: true}
+	events := make(map[string]bool)
+	users := make(map[string]bool)
+	str := func(d map[string]interface{}, k string) string {
+		s, _ := d[k].(string)
+		return s
+	}
+
+	// Members and invitations of the circle
+	for id, d := range docs {
+		if str(d, "circle") != circle {
+			continue
+		}
+		switch str(d, "type") {
+		case "member":
+			keep[id] = true
+			users[str(d, "user")] = true
+		case "invitation":
+			keep[id] = true
+			events[str(d, "event")] = true
+		}
+	}
+
+	// Participants of the events
+	for id, d := range docs {
+		if str(d, "type") == "participant" && events[str(d, "event")] {
+			keep[id] = true
+			users[str(d, "user")] = true
+		}
+	}
+	for id := range events {
+		keep[id] = true
+	}
+	for id := range users {
+		keep[id] = true
+	}
+
+	// Dismissed notifications of the users about kept documents, and their email claims
+	for id, d := range docs {
+		switch t := str(d, "type"); {
+		case t == "dismiss" && users[str(d, "user")] && keep[str(d, "what")]:
+			keep[id] = true
+		case t == "email" && users[str(d, "user")]:
+			keep[id] = true
+		}
+	}
+
+	subset := make(map[string]map[string]interface{})
+	for id := range keep {
+		if d, ok := docs[id]; ok {
+			subset[id] = d
+		}
+	}
+	return subset
+}
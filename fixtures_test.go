@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFixturesRoundTrip(t *testing.T) {
+	db, m := fixtureDB(t)
+	ctx := context.Background()
+	for _, id := range []string{"u1", "team/u1", "100%"} {
+		if _, err := m.Put(ctx, id, map[string]interface{}{"type": "user", "name": id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+	n, err := db.DumpFixtures(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != n {
+		t.Fatalf("got %d files for %d documents", len(files), n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "team%2Fu1.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Documents without _id take the one of their file name
+	if err := os.WriteFile(filepath.Join(dir, "a%2Fb.json"), []byte(`{"type": "circle"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewMemory()
+	if err := l.LoadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"u1", "team/u1", "100%", "u0sim", "a/b"} {
+		var d map[string]interface{}
+		if err := l.Get(ctx, id, &d); err != nil {
+			t.Errorf("%q: %v", id, err)
+		}
+	}
+	var want, got user
+	m.Get(ctx, "team/u1", &want)
+	l.Get(ctx, "team/u1", &got)
+	want.Rev, got.Rev = "", ""
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
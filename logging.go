@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// redacted replaces sensitive values in logs.
+const redacted = "[REDACTED]"
+
+// opKey is the context key of the logical operation of requests.
+type opKey struct{}
+
+// withOp returns a context carrying the name of a logical operation, such as "get notifications".
+func withOp(ctx context.Context, op string) context.Context {
+	return context.WithValue(ctx, opKey{}, op)
+}
+
+// opFrom returns the logical operation carried by a context, or "".
+func opFrom(ctx context.Context) string {
+	op, _ := ctx.Value(opKey{}).(string)
+	return op
+}
+
+// logTransport is an http.RoundTripper logging every request to CouchDB.
+// Successful requests are logged at debug level, along with their redacted body;
+// server errors and transport failures at warning level.
+type logTransport struct {
+	rt   http.RoundTripper
+	log  *slog.Logger
+	base string // path of the database, such as "/toople"
+}
+
+func (t *logTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx := r.Context()
+	start := time.Now()
+	res, err := t.rt.RoundTrip(r)
+
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("op", opFrom(ctx)),
+	}
+	attrs = append(attrs, t.target(r.URL.Path)...)
+	attrs = append(attrs, slog.Duration("latency", time.Since(start)))
+	level := slog.LevelDebug
+	if err != nil {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.String("error", err.Error()))
+	} else {
+		attrs = append(attrs, slog.Int("status", res.StatusCode))
+		if res.StatusCode >= 500 {
+			level = slog.LevelWarn
+		}
+	}
+	if t.log.Enabled(ctx, slog.LevelDebug) && r.GetBody != nil {
+		if b, err := r.GetBody(); err == nil {
+			body, _ := io.ReadAll(b)
+			b.Close()
+			if len(body) > 0 {
+				attrs = append(attrs, slog.String("body", redact(body, r.Header.Get("Content-Type"))))
+			}
+		}
+	}
+	t.log.LogAttrs(ctx, level, "couchdb request", attrs...)
+	return res, err
+}
+
+// target returns the log attributes of the target of a request: view, document or endpoint.
+func (t *logTransport) target(path string) []slog.Attr {
+	kind, name := target(t.base, path)
+	switch kind {
+	case "":
+		return nil
+	case "doc":
+		name = redactId(name)
+	}
+	return []slog.Attr{slog.String(kind, name)}
+}
+
+// target classifies the path of a request to the database at base:
+// it returns the kind of target ("view", "doc" or "endpoint") and its name,
+// or "" for the database itself and the creation of documents.
+func target(base, path string) (kind, name string) {
+	p, ok := strings.CutPrefix(path, base+"/")
+	if !ok {
+		if path == base {
+			return "", ""
+		}
+		return "endpoint", path
+	}
+	switch {
+	case p == "":
+		return "", "" // new document
+	case strings.HasPrefix(p, "_design/toople/_view/"):
+		return "view", strings.TrimPrefix(p, "_design/toople/_view/")
+	case strings.HasPrefix(p, "_design/"):
+		return "doc", p
+	case strings.HasPrefix(p, "_"):
+		return "endpoint", p
+	}
+	return "doc", p
+}
+
+// redact returns a body with passwords, password hashes and email addresses replaced.
+func redact(body []byte, contentType string) string {
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		v, err := url.ParseQuery(string(body))
+		if err != nil {
+			return redacted
+		}
+		if v.Has("password") {
+			v.Set("password", redacted)
+		}
+		return v.Encode()
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return redacted
+	}
+	b, _ := json.Marshal(redactJSON(v)) // v was decoded from JSON
+	return string(b)
+}
+
+// redactJSON replaces the values of password fields, and the strings and field names
+// looking like bcrypt hashes or email addresses, such as the keys of verified addresses.
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		r := make(map[string]interface{}, len(v))
+		for k, w := range v {
+			if sensitive(k) {
+				w = redacted
+			} else {
+				w = redactJSON(w)
+			}
+			if isEmail(k) {
+				k = redacted
+			}
+			r[k] = w
+		}
+		return r
+	case []interface{}:
+		for i, w := range v {
+			v[i] = redactJSON(w)
+		}
+	case string:
+		if isHash(v) || isEmail(v) {
+			return redacted
+		}
+	}
+	return v
+}
+
+// redactId returns the id of a document, with the address of email claims replaced.
+func redactId(id string) string {
+	if strings.HasPrefix(id, claimId("")) {
+		return claimId(redacted)
+	}
+	return id
+}
+
+// sensitive reports whether a field holds a secret.
+func sensitive(field string) bool {
+	return field == "password"
+}
+
+// isHash reports whether a string looks like a bcrypt hash.
+func isHash(s string) bool {
+	return len(s) == 60 && (strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$"))
+}
+
+// isEmail reports whether a string looks like an email address or the id of an email claim:
+// an @ between other characters, and no spaces.
+func isEmail(s string) bool {
+	n := strings.LastIndex(s, "@")
+	return n > 0 && n < len(s)-1 && !strings.ContainsAny(s, " \t\n")
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	for _, c := range []struct {
+		body, contentType, want string
+	}{
+		{
+			`{"_id":"u0sim","name":"Simon","emails":["sim@example.com"],"verified":{"sim@example.com":"2014-08-02T09:21:41Z"},` +
+				`"password":"secret"}`,
+			"application/json",
+			`{"_id":"u0sim","emails":["[REDACTED]"],"name":"Simon","password":"[REDACTED]","verified":{"[REDACTED]":"2014-08-02T09:21:41Z"}}`,
+		},
+		{
+			`{"docs":[{"_id":"email:sim@example.com","type":"email","user":"u0sim"},{"info":"meet @ the pool"}]}`,
+			"application/json",
+			`{"docs":[{"_id":"[REDACTED]","type":"email","user":"u0sim"},{"info":"meet @ the pool"}]}`,
+		},
+		{
+			`{"password":"$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"}`,
+			"application/json",
+			`{"password":"[REDACTED]"}`,
+		},
+		{"name=toople&password=secret", "application/x-www-form-urlencoded", "name=toople&password=%5BREDACTED%5D"},
+	} {
+		got := redact([]byte(c.body), c.contentType)
+		if c.contentType == "application/json" {
+			var g, w interface{}
+			json.Unmarshal([]byte(got), &g)
+			json.Unmarshal([]byte(c.want), &w)
+			if !reflect.DeepEqual(g, w) {
+				t.Errorf("%s: got %s, want %s", c.body, got, c.want)
+			}
+		} else if got != c.want {
+			t.Errorf("%s: got %s, want %s", c.body, got, c.want)
+		}
+	}
+}
+
+func TestLogTarget(t *testing.T) {
+	lt := &logTransport{base: "/toople"}
+	for _, c := range []struct {
+		path, key, value string
+	}{
+		{"/toople/u0sim", "doc", "u0sim"},
+		{"/toople/email:sim@example.com", "doc", "email:" + redacted},
+		{"/toople/_design/toople/_view/email", "view", "email"},
+		{"/toople/_bulk_docs", "endpoint", "_bulk_docs"},
+	} {
+		attrs := lt.target(c.path)
+		if len(attrs) != 1 || attrs[0].Key != c.key || attrs[0].Value.String() != c.value {
+			t.Errorf("%s: got %v, want %s=%s", c.path, attrs, c.key, c.value)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package db
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Memory is a Store holding documents in memory.
+// Its views reproduce the map functions of the toople design document (see couchdb/views),
+// which makes it suitable for tests and development without a CouchDB server.
+type Memory struct {
+	mu      sync.RWMutex
+	docs    map[string]map[string]interface{}
+	deleted map[string]string // revisions of deleted documents
+	seq     int               // sequence of the last change
+	seqs    map[string]int    // sequence of the last change of each document
+	changed chan struct{}     // closed on the next change
+}
+
+// NewMemory returns an empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		docs:    make(map[string]map[string]interface{}),
+		deleted: make(map[string]string),
+		seqs:    make(map[string]int),
+		changed: make(chan struct{}),
+	}
+}
+
+// LoadDir loads every JSON document of a fixture directory such as couchdb/_docs.
+// Documents already present with the same id are replaced.
+func (m *Memory) LoadDir(dir string) error {
+	docs, err := readFixtures(dir)
+	if err != nil {
+		return stack(err, "memory")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range docs {
+		m.store(d["_id"].(string), d, 0)
+	}
+	return nil
+}
+
+// Get decodes the document with the given id into doc.
+func (m *Memory) Get(ctx context.Context, id string, doc interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return stack(err, "memory: cannot get %q", id)
+	}
+	m.mu.RLock()
+	d, ok := m.docs[id]
+	var b []byte
+	var err error
+	if ok {
+		b, err = json.Marshal(d)
+	}
+	m.mu.RUnlock()
+	if !ok {
+		return stack(ErrNotFound, "memory: get %q", id)
+	}
+	if err != nil {
+		return stack(err, "memory: error encoding %q", id)
+	}
+	return stack(json.Unmarshal(b, doc), "memory: error decoding %q", id)
+}
+
+// Create stores a new document and returns its generated id and revision.
+func (m *Memory) Create(ctx context.Context, doc interface{}) (string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", stack(err, "memory: cannot create document")
+	}
+	d, err := toMap(doc)
+	if err != nil {
+		return "", "", err
+	}
+	id, _ := d["_id"].(string)
+	if id == "" {
+		id = uuid()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.docs[id]; ok {
+		return "", "", stack(ErrConflict, "memory: create %q", id)
+	}
+	return id, m.store(id, d, revNumber(m.deleted[id])), nil
+}
+
+// CreateAll stores new documents and returns the outcome for each of them, in order.
+func (m *Memory) CreateAll(ctx context.Context, docs []interface{}) ([]BulkResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, stack(err, "memory: cannot create documents")
+	}
+	res := make([]BulkResult, len(docs))
+	for i, doc := range docs {
+		res[i].Id, res[i].Rev, res[i].Err = m.Create(ctx, doc)
+	}
+	return res, nil
+}
+
+// Put creates or updates the document with the given id and returns its new revision.
+func (m *Memory) Put(ctx context.Context, id string, doc interface{}) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", stack(err, "memory: cannot put %q", id)
+	}
+	d, err := toMap(doc)
+	if err != nil {
+		return "", err
+	}
+	rev, _ := d["_rev"].(string)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	if old, ok := m.docs[id]; ok {
+		if old["_rev"] != rev {
+			return "", stack(ErrConflict, "memory: put %q", id)
+		}
+		n = revNumber(rev)
+	} else if t, ok := m.deleted[id]; ok {
+		if rev != "" && rev != t {
+			return "", stack(ErrConflict, "memory: put %q", id)
+		}
+		n = revNumber(t)
+	} else if rev != "" {
+		return "", stack(ErrConflict, "memory: put %q", id)
+	}
+	return m.store(id, d, n), nil
+}
+
+// Delete removes the document with the given id and revision.
+func (m *Memory) Delete(ctx context.Context, id, rev string) error {
+	if err := ctx.Err(); err != nil {
+		return stack(err, "memory: cannot delete %q", id)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.docs[id]
+	if !ok {
+		return stack(ErrNotFound, "memory: delete %q", id)
+	}
+	if d["_rev"] != rev {
+		return stack(ErrConflict, "memory: delete %q", id)
+	}
+	delete(m.docs, id)
+	m.deleted[id] = nextRev(revNumber(rev), map[string]interface{}{"_id": id, "_deleted": true})
+	m.change(id)
+	return nil
+}
+
+// Infos returns the metadata of documents, in the order of ids.
+func (m *Memory) Infos(ctx context.Context, ids []string) ([]DocInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, stack(err, "memory: cannot get document infos")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	infos := make([]DocInfo, len(ids))
+	for i, id := range ids {
+		infos[i].Id = id
+		if d, ok := m.docs[id]; ok {
+			infos[i].Rev = d["_rev"].(string)
+			infos[i].Type, _ = d["type"].(string)
+		} else if rev, ok := m.deleted[id]; ok {
+			infos[i].Rev = rev
+			infos[i].Deleted = true
+		}
+	}
+	return infos, nil
+}
+
+// Scan calls fn with every document whose id sorts after the given one, in id order.
+func (m *Memory) Scan(ctx context.Context, after string, fn func(doc map[string]interface{}) error) error {
+	m.mu.RLock()
+	ids := make([]string, 0, len(m.docs))
+	for id := range m.docs {
+		if id > after && !strings.HasPrefix(id, "_design/") {
+			ids = append(ids, id)
+		}
+	}
+	m.mu.RUnlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return stack(err, "memory: scan interrupted")
+		}
+		var d map[string]interface{}
+		if err := m.Get(ctx, id, &d); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue // deleted meanwhile
+			}
+			return err
+		}
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Changes returns the changes after the since sequence, in order, and the sequence to pass next.
+// Sequences are decimal numbers. If wait is true, it waits for a change until ctx is done.
+func (m *Memory) Changes(ctx context.Context, since string, wait bool) ([]Change, string, error) {
+	n := 0
+	switch since {
+	case "":
+	case "now":
+		m.mu.RLock()
+		n = m.seq
+		m.mu.RUnlock()
+	default:
+		var err error
+		if n, err = strconv.Atoi(since); err != nil {
+			return nil, "", invalid("since", "is not a sequence of the memory store")
+		}
+	}
+	for {
+		m.mu.RLock()
+		changes := m.changesAfter(n)
+		last, changed := m.seq, m.changed
+		m.mu.RUnlock()
+		if len(changes) > 0 || !wait {
+			return changes, strconv.Itoa(last), nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, strconv.Itoa(n), stack(ctx.Err(), "memory: changes feed interrupted")
+		}
+	}
+}
+
+// changesAfter returns the changes after sequence n, in order.
+// The caller must hold the read lock.
+func (m *Memory) changesAfter(n int) []Change {
+	var changes []Change
+	for id, s := range m.seqs {
+		if s <= n {
+			continue
+		}
+		c := Change{Seq: strconv.Itoa(s), Id: id}
+		if d, ok := m.docs[id]; ok {
+			b, _ := json.Marshal(d) // d was decoded from JSON
+			json.Unmarshal(b, &c.Doc)
+		} else {
+			c.Deleted = true
+		}
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return m.seqs[changes[i].Id] < m.seqs[changes[j].Id]
+	})
+	return changes
+}
+
+// A memoryRow is a row of a view, as returned by CouchDB.
+type memoryRow struct {
+	Id    string      `json:"id"`
+	Key   interface{} `json:"key"`
+	Value interface{} `json:"value"`
+	Doc   interface{} `json:"doc,omitempty"`
+}
+
+// Query decodes the rows of a view matching key into out.
+func (m *Memory) Query(ctx context.Context, view View, key string, includeDocs bool, out interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return stack(err, "memory: cannot query %s view", view)
+	}
+	m.mu.RLock()
+	rows := make([]memoryRow, 0)
+	for id, d := range m.docs {
+		for _, r := range emit(view, d) {
+			k := r.Key
+			if view.Dated() {
+				k = r.Key.([]interface{})[0]
+			}
+			if k != key {
+				continue
+			}
+			r.Id = id
+			if includeDocs {
+				r.Doc = m.linkedDoc(r.Value, d)
+			}
+			rows = append(rows, r)
+		}
+	}
+	sort.Sort(byKey(rows))
+	b, err := json.Marshal(struct {
+		TotalRows int         `json:"total_rows"`
+		Offset    int         `json:"offset"`
+		Rows      []memoryRow `json:"rows"`
+	}{len(rows), 0, rows})
+	m.mu.RUnlock()
+	if err != nil {
+		return stack(err, "memory: error encoding %s view", view)
+	}
+	return stack(json.Unmarshal(b, out), "memory: error decoding %s view", view)
+}
+
+// linkedDoc returns the document included in a view row:
+// the document referenced by the value's _id if any, or the emitting document.
+// Like CouchDB, it returns nil for a reference to a missing document.
+func (m *Memory) linkedDoc(value interface{}, d map[string]interface{}) interface{} {
+	if v, ok := value.(map[string]interface{}); ok {
+		if id, ok := v["_id"].(string); ok {
+			if l, ok := m.docs[id]; ok {
+				return l
+			}
+			return nil
+		}
+	}
+	return d
+}
+
+// emit reproduces the map function of a view (see couchdb/views/*/map.js).
+func emit(view View, d map[string]interface{}) []memoryRow {
+	t, _ := d["type"].(string)
+	switch {
+	case view == ViewCircles && t == "member":
+		return []memoryRow{{Key: d["user"], Value: ref(d["circle"])}}
+	case view == ViewMembers && t == "member":
+		return []memoryRow{{Key: []interface{}{d["circle"], d["date"]}, Value: ref(d["user"])}}
+	case view == ViewParticipants && t == "participant":
+		return []memoryRow{{Key: []interface{}{d["event"], d["date"]}, Value: ref(d["user"])}}
+	case view == ViewEvents && t == "invitation":
+		return []memoryRow{{Key: d["circle"], Value: ref(d["event"])}}
+	case view == ViewEmail && t == "user":
+		emails, _ := d["emails"].([]interface{})
+		rows := make([]memoryRow, len(emails))
+		for i, e := range emails {
+			rows[i] = memoryRow{Key: e}
+		}
+		return rows
+	case view == ViewSlug && t == "circle":
+		return []memoryRow{{Key: d["slug"]}}
+	case view == ViewDismiss && t == "dismiss":
+		return []memoryRow{{Key: d["user"], Value: d["what"]}}
+	case view == ViewTokens && (t == "verification" || t == "reset"):
+		return []memoryRow{{Key: d["user"], Value: d["type"]}}
+	}
+	return nil
+}
+
+// ref returns a view value linking to another document.
+func ref(id interface{}) map[string]interface{} {
+	return map[string]interface{}{"_id": id}
+}
+
+// byKey sorts view rows like CouchDB: by key, then by document id.
+// Keys of a query only differ by date, which sort as RFC 3339 strings.
+type byKey []memoryRow
+
+func (b byKey) Len() int      { return len(b) }
+func (b byKey) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byKey) Less(i, j int) bool {
+	ki, kj := fmt.Sprint(b[i].Key), fmt.Sprint(b[j].Key)
+	if ki != kj {
+		return ki < kj
+	}
+	return b[i].Id < b[j].Id
+}
+
+// store saves a document under the next revision after n and returns that revision.
+// The caller must hold the write lock.
+func (m *Memory) store(id string, d map[string]interface{}, n int) string {
+	delete(d, "_rev")
+	d["_id"] = id
+	rev := nextRev(n, d)
+	d["_rev"] = rev
+	m.docs[id] = d
+	delete(m.deleted, id)
+	m.change(id)
+	return rev
+}
+
+// change records a change of a document and wakes up the waiting readers of the changes feed.
+// The caller must hold the write lock.
+func (m *Memory) change(id string) {
+	m.seq++
+	m.seqs[id] = m.seq
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// nextRev returns the revision following number n for the content d.
+func nextRev(n int, d map[string]interface{}) string {
+	b, _ := json.Marshal(d) // d was decoded from JSON
+	sum := md5.Sum(b)
+	return strconv.Itoa(n+1) + "-" + hex.EncodeToString(sum[:])
+}
+
+// toMap converts a document to its generic JSON form.
+func toMap(doc interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, stack(err, "memory: error encoding document")
+	}
+	var d map[string]interface{}
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, stack(err, "memory: document is not a JSON object")
+	}
+	return d, nil
+}
+
+// revNumber returns the sequence number of a revision such as "3-abc".
+func revNumber(rev string) int {
+	n, _ := strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+	return n
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fixtureDB returns a DB backed by a Memory store loaded with couchdb/_docs.
+func fixtureDB(t *testing.T) (*DB, *Memory) {
+	t.Helper()
+	m := NewMemory()
+	if err := m.LoadDir("couchdb/_docs"); err != nil {
+		t.Fatal(err)
+	}
+	return NewWithStore(m), m
+}
+
+// date parses an RFC 3339 date of the fixtures.
+func date(t *testing.T, s string) time.Time {
+	t.Helper()
+	d, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// viewIds returns the ids of the rows of a view for a key, in order.
+func viewIds(t *testing.T, s Store, view View, key string) []string {
+	t.Helper()
+	var v struct{ Rows []struct{ Id string } }
+	if err := s.Query(context.Background(), view, key, false, &v); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, len(v.Rows))
+	for i, r := range v.Rows {
+		ids[i] = r.Id
+	}
+	return ids
+}
+
+// TestMemoryViews checks that the views of Memory match couchdb/views/*/map.js,
+// rows of [key, date] views being sorted by date rather than by id.
+func TestMemoryViews(t *testing.T) {
+	_, m := fixtureDB(t)
+	for _, c := range []struct {
+		view View
+		key  string
+		want []string
+	}{
+		{ViewMembers, "c0kus", []string{"m0kus1kus", "m0amin1kus", "m0imene1kus", "m0sim1kus"}},
+		{ViewParticipants, "e0movie", []string{"p0sim1movie", "p0amin1movie", "p0imene1movie"}},
+		{ViewCircles, "u0sim", []string{"m0sim1clab", "m0sim1kus"}},
+		{ViewEvents, "c0kus", []string{"i0kus1frisbee", "i0kus1movie", "i0kus1swim"}},
+		{ViewEmail, "igoumiri@princeton.edu", []string{"u0imene"}},
+		{ViewSlug, "kuskus", []string{"c0kus"}},
+		{ViewMembers, "c0none", []string{}},
+	} {
+		if got := viewIds(t, m, c.view, c.key); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s view %q: got %v, want %v", c.view, c.key, got, c.want)
+		}
+	}
+}
+
+func TestMemoryIncludeDocs(t *testing.T) {
+	_, m := fixtureDB(t)
+	var v struct {
+		Rows []struct {
+			Key []interface{}
+			Doc user
+		}
+	}
+	if err := m.Query(context.Background(), ViewParticipants, "e0movie", true, &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Rows) != 3 {
+		t.Fatalf("got %d rows, want 3", len(v.Rows))
+	}
+	// Documents are the users linked by the values, not the participants emitting them
+	if v.Rows[0].Doc.Id != "u0sim" || v.Rows[0].Doc.Name != "Simon" {
+		t.Errorf("got doc %+v, want user u0sim", v.Rows[0].Doc)
+	}
+	if v.Rows[0].Key[0] != "e0movie" || v.Rows[0].Key[1] != "2014-08-02T09:21:41Z" {
+		t.Errorf("got key %v, want [e0movie 2014-08-02T09:21:41Z]", v.Rows[0].Key)
+	}
+}
+
+func TestGetCircles(t *testing.T) {
+	db, _ := fixtureDB(t)
+	got, err := db.GetCircles("u0sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Circle{
+		{Id: "c0clab", Name: "Couzin Lab", Slug: "couzinlab"},
+		{Id: "c0kus", Name: "Kuskus team", Slug: "kuskus"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestGetNotifications(t *testing.T) {
+	db, _ := fixtureDB(t)
+	n, err := db.GetNotifications("u0sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		Id, Status   string
+		Participants []string
+	}
+	var events []entry
+	var members []string
+	for _, x := range n {
+		switch {
+		case x.Event != nil:
+			e := entry{Id: x.Event.Id, Status: x.Event.Status}
+			for _, p := range x.Event.Participants {
+				e.Participants = append(e.Participants, p.Id)
+			}
+			events = append(events, e)
+		case x.Member != nil:
+			members = append(members, x.Member.User.Id+"@"+x.Member.Circle.Id)
+		}
+	}
+	wantEvents := []entry{
+		{"e0swim", "Cancelled", []string{"u0amin"}},
+		{"e0movie", "Confirmed", []string{"u0sim", "u0amin", "u0imene"}},
+		{"e0frisbee", "Cancelled", []string{"u0kus"}},
+	}
+	if !reflect.DeepEqual(events, wantEvents) {
+		t.Errorf("got events %v, want %v", events, wantEvents)
+	}
+	wantMembers := []string{"u0sim@c0clab", "u0sim@c0kus", "u0imene@c0kus", "u0amin@c0kus", "u0kus@c0kus"}
+	if !reflect.DeepEqual(members, wantMembers) {
+		t.Errorf("got members %v, want %v", members, wantMembers)
+	}
+	for i := 1; i < len(n); i++ {
+		if n[i].Date().After(n[i-1].Date()) {
+			t.Errorf("notification %d is more recent than the previous one", i)
+		}
+	}
+
+	// The creator of an event is its first participant
+	for _, x := range n {
+		if x.Event != nil && x.Event.Id == "e0movie" {
+			if x.Event.Creator.Id != "u0sim" || !x.Event.Created.Equal(date(t, "2014-08-02T09:21:41Z")) {
+				t.Errorf("got creator %v at %v, want u0sim", x.Event.Creator, x.Event.Created)
+			}
+		}
+	}
+}
+
+func TestJoinEvent(t *testing.T) {
+	db, m := fixtureDB(t)
+	if err := db.JoinEvent("e0swim", "u0sim"); err != nil {
+		t.Fatal(err)
+	}
+	got := viewIds(t, m, ViewParticipants, "e0swim")
+	if len(got) != 2 || got[0] != "p0amin1swim" {
+		t.Fatalf("got participants %v, want p0amin1swim then the new one", got)
+	}
+
+	// Joining twice does nothing
+	if err := db.JoinEvent("e0swim", "u0sim"); err != nil {
+		t.Fatal(err)
+	}
+	if again := viewIds(t, m, ViewParticipants, "e0swim"); !reflect.DeepEqual(again, got) {
+		t.Errorf("got participants %v after joining twice, want %v", again, got)
+	}
+
+	// The new participant comes after the earlier ones
+	n, err := db.GetNotifications("u0sim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range n {
+		if x.Event != nil && x.Event.Id == "e0swim" {
+			if len(x.Event.Participants) != 2 || x.Event.Participants[1].Id != "u0sim" {
+				t.Errorf("got participants %v, want u0amin and u0sim", x.Event.Participants)
+			}
+			return
+		}
+	}
+	t.Error("no notification of e0swim")
+}
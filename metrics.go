@@ -0,0 +1,140 @@
+package db
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics holds the Prometheus collectors of a DB:
+// requests to CouchDB by method, view and status class, and operations by outcome.
+// It is a prometheus.Collector, to be registered by the caller:
+//
+//	m := db.NewMetrics()
+//	prometheus.MustRegister(m)
+//	d, err := db.Open(dsn, db.WithMetrics(m))
+//
+// Requests are also counted by operation, so that dividing
+// toople_db_requests_total{op="get notifications"} by
+// toople_db_operations_total{op="get notifications"}
+// gives the number of requests of each call to GetNotifications.
+type Metrics struct {
+	requests   *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+	inFlight   prometheus.Gauge
+	operations *prometheus.CounterVec
+	auths      *prometheus.CounterVec
+}
+
+// NewMetrics returns unregistered collectors.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "toople",
+			Subsystem: "db",
+			Name:      "requests_total",
+			Help:      "Requests to CouchDB by operation, HTTP method, view and status class.",
+		}, []string{"op", "method", "view", "status"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "toople",
+			Subsystem: "db",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of requests to CouchDB by HTTP method, view and status class.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "view", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "toople",
+			Subsystem: "db",
+			Name:      "requests_in_flight",
+			Help:      "Requests to CouchDB waiting for a response.",
+		}),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "toople",
+			Subsystem: "db",
+			Name:      "operations_total",
+			Help:      "Operations of the DB, such as \"new user\" or \"join event\", by result (ok or error).",
+		}, []string{"op", "result"}),
+		auths: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "toople",
+			Subsystem: "db",
+			Name:      "auths_total",
+			Help:      "Authentication attempts by result (success or failure).",
+		}, []string{"result"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requests.Describe(ch)
+	m.latency.Describe(ch)
+	m.inFlight.Describe(ch)
+	m.operations.Describe(ch)
+	m.auths.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.requests.Collect(ch)
+	m.latency.Collect(ch)
+	m.inFlight.Collect(ch)
+	m.operations.Collect(ch)
+	m.auths.Collect(ch)
+}
+
+// operation counts an operation of the DB ending with err.
+// It does nothing on nil metrics.
+func (m *Metrics) operation(op string, err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.operations.WithLabelValues(op, result).Inc()
+}
+
+// auth counts an authentication attempt.
+// It does nothing on nil metrics.
+func (m *Metrics) auth(ok bool) {
+	if m == nil {
+		return
+	}
+	result := "failure"
+	if ok {
+		result = "success"
+	}
+	m.auths.WithLabelValues(result).Inc()
+}
+
+// metricsTransport is an http.RoundTripper measuring every request to CouchDB.
+type metricsTransport struct {
+	rt   http.RoundTripper
+	m    *Metrics
+	base string // path of the database, such as "/toople"
+}
+
+func (t *metricsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.m.inFlight.Inc()
+	start := time.Now()
+	res, err := t.rt.RoundTrip(r)
+	d := time.Since(start)
+	t.m.inFlight.Dec()
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode/100) + "xx"
+	}
+	view := ""
+	switch kind, name := target(t.base, r.URL.Path); kind {
+	case "view", "endpoint":
+		view = name
+	case "doc":
+		view = "doc" // one label for all documents
+	}
+	t.m.requests.WithLabelValues(opFrom(r.Context()), r.Method, view, status).Inc()
+	t.m.latency.WithLabelValues(r.Method, view, status).Observe(d.Seconds())
+	return res, err
+}
@@ -0,0 +1,225 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A Migration transforms the documents of one type to a new schema.
+type Migration struct {
+	// Id identifies the migration in the tracking document, such as "0001-member-rights".
+	// It must be unique and never change once the migration has been applied.
+	Id string
+
+	// Type is the type of the documents the migration applies to, such as "member".
+	Type string
+
+	// Apply changes a document in place and reports whether it changed.
+	// It must be idempotent since an interrupted migration can see documents twice.
+	Apply func(doc map[string]interface{}) (bool, error)
+}
+
+// A MigrationResult reports what a migration did, or would do in a dry run.
+type MigrationResult struct {
+	Id       string
+	Affected int // number of documents changed
+}
+
+var (
+	migrationsMu sync.Mutex
+	migrations   []Migration
+)
+
+// RegisterMigration registers a migration to be applied by Migrate.
+// Migrations are applied in the order in which they are registered.
+// It panics if a migration with the same id was already registered.
+func RegisterMigration(m Migration) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	if m.Id == "" || m.Type == "" || m.Apply == nil {
+		panic("db: RegisterMigration: incomplete migration")
+	}
+	for _, n := range migrations {
+		if n.Id == m.Id {
+			panic("db: RegisterMigration: duplicate migration " + m.Id)
+		}
+	}
+	migrations = append(migrations, m)
+}
+
+// migrationsId is the id of the document tracking applied migrations.
+const migrationsId = "toople-migrations"
+
+// migrationsCheckpoint is the number of documents between two saves of the progress of a migration.
+const migrationsCheckpoint = 100
+
+// A migrationLog is the CouchDB document tracking applied migrations.
+type migrationLog struct {
+	Id      string             `json:"_id"`
+	Rev     string             `json:"_rev,omitempty"`
+	Type    string             `json:"type"`
+	Applied []appliedMigration `json:"applied"`
+
+	// Progress of an interrupted migration
+	Current    string `json:"current,omitempty"`    // id of the migration
+	Checkpoint string `json:"checkpoint,omitempty"` // id of the last document processed
+	Affected   int    `json:"affected,omitempty"`   // number of documents changed so far
+}
+
+// An appliedMigration is an entry of a migration log.
+type appliedMigration struct {
+	Id       string    `json:"id"`
+	Date     time.Time `json:"date"`
+	Affected int       `json:"affected"`
+}
+
+// Migrate applies the registered migrations that have not been applied yet, in order,
+// and records them in a tracking document. An interrupted migration resumes where it stopped.
+// In a dry run, nothing is written and the results tell how many documents would change,
+// each migration counting the documents as changed in memory by the previous ones.
+func (db *DB) Migrate(dryRun bool) ([]MigrationResult, error) {
+	return db.MigrateContext(context.Background(), dryRun)
+}
+
+// MigrateContext is like Migrate but passes ctx down to every database request.
+func (db *DB) MigrateContext(ctx context.Context, dryRun bool) (_ []MigrationResult, err error) {
+	ctx, end := db.operation(ctx, "migrate")
+	defer end(&err)
+
+	migrationsMu.Lock()
+	ms := append([]Migration(nil), migrations...)
+	migrationsMu.Unlock()
+
+	// Get tracking document
+	l := migrationLog{Id: migrationsId, Type: "migrations"}
+	if err := db.store.Get(ctx, migrationsId, &l); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, stack(err, "migrate: cannot get migration log")
+	}
+	applied := make(map[string]bool)
+	for _, a := range l.Applied {
+		applied[a.Id] = true
+	}
+	var pending []Migration
+	for _, m := range ms {
+		if !applied[m.Id] {
+			pending = append(pending, m)
+		}
+	}
+
+	if dryRun {
+		results, err := db.dryRun(ctx, &l, pending)
+		return results, stack(err, "migrate")
+	}
+	results := make([]MigrationResult, 0)
+	for _, m := range pending {
+		n, err := db.migrate(ctx, &l, m)
+		results = append(results, MigrationResult{Id: m.Id, Affected: n})
+		if err != nil {
+			return results, stack(err, "migrate: %s", m.Id)
+		}
+	}
+	return results, nil
+}
+
+// migrate applies a migration, resuming from the checkpoint of the log if it was interrupted,
+// and returns the number of documents changed.
+func (db *DB) migrate(ctx context.Context, l *migrationLog, m Migration) (int, error) {
+	after, n := "", 0
+	if l.Current == m.Id {
+		after, n = l.Checkpoint, l.Affected
+	}
+	seen := 0
+	err := db.store.Scan(ctx, after, func(doc map[string]interface{}) error {
+		if doc["type"] == m.Type {
+			changed, err := db.migrateDoc(ctx, m, doc)
+			if err != nil {
+				return err
+			}
+			if changed {
+				n++
+			}
+		}
+		seen++
+		if seen%migrationsCheckpoint == 0 {
+			l.Current, l.Checkpoint, l.Affected = m.Id, doc["_id"].(string), n
+			return db.saveMigrationLog(ctx, l)
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	l.Applied = append(l.Applied, appliedMigration{Id: m.Id, Date: time.Now(), Affected: n})
+	l.Current, l.Checkpoint, l.Affected = "", "", 0
+	return n, db.saveMigrationLog(ctx, l)
+}
+
+// dryRun returns the number of documents each pending migration would change.
+// Migrations are applied in order to every document in memory, so that chained migrations
+// of a type count the documents as the previous ones leave them. Nothing is written.
+func (db *DB) dryRun(ctx context.Context, l *migrationLog, ms []Migration) ([]MigrationResult, error) {
+	results := make([]MigrationResult, len(ms))
+	for i, m := range ms {
+		results[i].Id = m.Id
+		if l.Current == m.Id {
+			results[i].Affected = l.Affected // documents before the checkpoint are migrated already
+		}
+	}
+	err := db.store.Scan(ctx, "", func(doc map[string]interface{}) error {
+		for i, m := range ms {
+			if doc["type"] != m.Type {
+				continue
+			}
+			changed, err := m.Apply(doc)
+			if err != nil {
+				return stack(err, "%s: document %q", m.Id, doc["_id"])
+			}
+			if changed {
+				results[i].Affected++
+			}
+		}
+		return nil
+	})
+	return results, err
+}
+
+// migrateDoc applies a migration to a document and saves it.
+// On a conflict, the document is fetched again and the migration applied once more.
+func (db *DB) migrateDoc(ctx context.Context, m Migration, doc map[string]interface{}) (bool, error) {
+	id, _ := doc["_id"].(string)
+	for try := 0; ; try++ {
+		changed, err := m.Apply(doc)
+		if err != nil {
+			return false, stack(err, "document %q", id)
+		}
+		if !changed {
+			return false, nil
+		}
+		_, err = db.store.Put(ctx, id, doc)
+		if !errors.Is(err, ErrConflict) || try > 0 {
+			return err == nil, stack(err, "cannot save %q", id)
+		}
+		doc = make(map[string]interface{})
+		if err := db.store.Get(ctx, id, &doc); err != nil {
+			return false, stack(err, "cannot get %q", id)
+		}
+	}
+}
+
+// saveMigrationLog saves the migration log and updates its revision.
+func (db *DB) saveMigrationLog(ctx context.Context, l *migrationLog) error {
+	rev, err := db.store.Put(ctx, migrationsId, l)
+	if err != nil {
+		return stack(err, "cannot save migration log")
+	}
+	l.Rev = rev
+	return nil
+}
+
+// String returns a summary of the result, such as "0001-member-rights: 12 documents".
+func (r MigrationResult) String() string {
+	return fmt.Sprintf("%s: %d documents", r.Id, r.Affected)
+}
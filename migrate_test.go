@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// withMigrations replaces the registered migrations for the duration of a test.
+func withMigrations(t *testing.T, ms ...Migration) {
+	t.Helper()
+	migrationsMu.Lock()
+	saved := migrations
+	migrations = nil
+	migrationsMu.Unlock()
+	t.Cleanup(func() {
+		migrationsMu.Lock()
+		migrations = saved
+		migrationsMu.Unlock()
+	})
+	for _, m := range ms {
+		RegisterMigration(m)
+	}
+}
+
+// Chained migrations of members: rights become roles, then roles get an admin flag.
+var (
+	rolesMigration = Migration{Id: "0001-roles", Type: "member", Apply: func(d map[string]interface{}) (bool, error) {
+		r, ok := d["rights"]
+		if !ok {
+			return false, nil
+		}
+		d["roles"] = r
+		delete(d, "rights")
+		return true, nil
+	}}
+	adminMigration = Migration{Id: "0002-admin", Type: "member", Apply: func(d map[string]interface{}) (bool, error) {
+		_, roles := d["roles"]
+		_, admin := d["admin"]
+		if !roles || admin {
+			return false, nil
+		}
+		d["admin"] = false
+		return true, nil
+	}}
+)
+
+func TestMigrateDryRun(t *testing.T) {
+	db, m := fixtureDB(t)
+	withMigrations(t, rolesMigration, adminMigration)
+	_, before, err := m.Changes(context.Background(), "now", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The admin migration counts the members as the roles migration would leave them
+	want := []MigrationResult{{"0001-roles", 5}, {"0002-admin", 5}}
+	got, err := db.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dry run: got %v, want %v", got, want)
+	}
+	if _, after, _ := m.Changes(context.Background(), "now", false); after != before {
+		t.Error("dry run wrote documents")
+	}
+
+	got, err = db.Migrate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("migration: got %v, want %v", got, want)
+	}
+	var d map[string]interface{}
+	if err := m.Get(context.Background(), "m0sim1kus", &d); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d["rights"]; ok || d["admin"] != false {
+		t.Errorf("got %v, want a migrated member", d)
+	}
+	if got, err := db.Migrate(true); err != nil || len(got) != 0 {
+		t.Errorf("got %v, %v, want nothing left to migrate", got, err)
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	db, m := fixtureDB(t)
+	ctx := context.Background()
+
+	// The roles migration was interrupted after the first two members (in id order)
+	var seen []string
+	roles := rolesMigration
+	roles.Apply = func(d map[string]interface{}) (bool, error) {
+		seen = append(seen, d["_id"].(string))
+		return rolesMigration.Apply(d)
+	}
+	withMigrations(t, roles)
+	for _, id := range []string{"m0amin1kus", "m0imene1kus"} {
+		var d map[string]interface{}
+		if err := m.Get(ctx, id, &d); err != nil {
+			t.Fatal(err)
+		}
+		rolesMigration.Apply(d)
+		if _, err := m.Put(ctx, id, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := migrationLog{Id: migrationsId, Type: "migrations", Current: roles.Id, Checkpoint: "m0imene1kus", Affected: 2}
+	if _, err := m.Put(ctx, migrationsId, &l); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.Migrate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []MigrationResult{{roles.Id, 5}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if want := []string{"m0kus1kus", "m0sim1clab", "m0sim1kus"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("migrated %v, want only the members after the checkpoint %v", seen, want)
+	}
+	var saved migrationLog
+	if err := m.Get(ctx, migrationsId, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Applied) != 1 || saved.Applied[0].Affected != 5 || saved.Current != "" {
+		t.Errorf("got log %+v, want the migration applied to 5 documents", saved)
+	}
+}
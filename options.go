@@ -0,0 +1,161 @@
+package db
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// An Option configures a DB created by Open or NewWithStore.
+type Option func(*options)
+
+// options holds the configuration set by options.
+type options struct {
+	couch   CouchDBConfig
+	timeout time.Duration
+	metrics *Metrics
+	tracer  trace.TracerProvider
+	cache   int
+
+	passwords       *PasswordPolicy
+	bcryptCost      int
+	verificationTTL time.Duration
+	resetTTL        time.Duration
+	verifiedOnly    bool
+}
+
+// db returns a DB backed by s configured with o.
+func (o *options) db(s Store) *DB {
+	if o.cache > 0 {
+		s = newCache(s, o.cache)
+	}
+	passwords := DefaultPasswordPolicy()
+	if o.passwords != nil {
+		passwords = *o.passwords
+	}
+	return &DB{
+		store:           s,
+		timeout:         o.timeout,
+		metrics:         o.metrics,
+		logger:          o.couch.Logger,
+		tracer:          tracer(o.tracer),
+		passwords:       passwords,
+		bcryptCost:      o.bcryptCost,
+		verificationTTL: o.verificationTTL,
+		resetTTL:        o.resetTTL,
+		verifiedOnly:    o.verifiedOnly,
+	}
+}
+
+// WithTimeout bounds each operation of the DB, such as GetNotifications,
+// including all of its database requests.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) { o.timeout = d }
+}
+
+// WithRequestTimeout bounds each HTTP request to CouchDB (see CouchDBConfig.RequestTimeout).
+func WithRequestTimeout(d time.Duration) Option {
+	return func(o *options) { o.couch.RequestTimeout = d }
+}
+
+// WithTransport sends the HTTP requests to CouchDB through rt (see CouchDBConfig.Transport).
+func WithTransport(rt http.RoundTripper) Option {
+	return func(o *options) { o.couch.Transport = rt }
+}
+
+// WithMaxConns limits the number of idle and total connections to CouchDB
+// (see CouchDBConfig.MaxIdleConns and CouchDBConfig.MaxConns).
+func WithMaxConns(idle, total int) Option {
+	return func(o *options) {
+		o.couch.MaxIdleConns = idle
+		o.couch.MaxConns = total
+	}
+}
+
+// WithUserAgent sets the User-Agent header of the HTTP requests to CouchDB.
+func WithUserAgent(ua string) Option {
+	return func(o *options) { o.couch.UserAgent = ua }
+}
+
+// WithLazyConnect skips connecting to CouchDB on startup (see CouchDBConfig.Lazy).
+func WithLazyConnect() Option {
+	return func(o *options) { o.couch.Lazy = true }
+}
+
+// WithLogger logs every request to CouchDB (see CouchDBConfig.Logger),
+// and the failures that do not fail operations, such as rehashing a password in AuthUser
+// or skipping a change in Watch.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) { o.couch.Logger = l }
+}
+
+// WithMetrics measures the requests to CouchDB and the operations of the DB with m.
+func WithMetrics(m *Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+		o.couch.Metrics = m
+	}
+}
+
+// WithTracerProvider starts the spans of the operations of the DB and of the requests to CouchDB
+// with the tracers of tp instead of the global OpenTelemetry provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) {
+		o.tracer = tp
+		o.couch.TracerProvider = tp
+	}
+}
+
+// WithCache keeps up to size user, circle and event documents in memory,
+// revalidated by revision before use unless the DB follows the changes feed
+// (see DB.FollowChanges). Statistics are returned by DB.CacheStats.
+func WithCache(size int) Option {
+	return func(o *options) { o.cache = size }
+}
+
+// WithPasswordPolicy sets the rules of the passwords users choose, DefaultPasswordPolicy() by default.
+// Existing passwords are not checked.
+func WithPasswordPolicy(p PasswordPolicy) Option {
+	return func(o *options) { o.passwords = &p }
+}
+
+// WithBcryptCost sets the bcrypt cost of password hashes, bcrypt.DefaultCost by default.
+// Hashes of a lower cost are replaced when their users log in (see AuthUser).
+func WithBcryptCost(cost int) Option {
+	return func(o *options) { o.bcryptCost = cost }
+}
+
+// WithVerificationTTL sets how long email verification tokens are valid (see IssueVerification).
+func WithVerificationTTL(d time.Duration) Option {
+	return func(o *options) { o.verificationTTL = d }
+}
+
+// WithResetTTL sets how long password reset tokens are valid (see RequestPasswordReset).
+func WithResetTTL(d time.Duration) Option {
+	return func(o *options) { o.resetTTL = d }
+}
+
+// WithVerifiedEmails ignores unverified email addresses in AuthUser and SendInvitation:
+// they can neither be used to log in nor be invited.
+// Addresses of users created before verification existed are not verified either.
+func WithVerifiedEmails() Option {
+	return func(o *options) { o.verifiedOnly = true }
+}
+
+// WithRetry sets the retry policy of requests to CouchDB.
+func WithRetry(p RetryPolicy) Option {
+	return func(o *options) { o.couch.Retry = p }
+}
+
+// WithBreaker sets the circuit breaker policy of requests to CouchDB.
+func WithBreaker(p BreakerPolicy) Option {
+	return func(o *options) { o.couch.Breaker = p }
+}
+
+// WithCouchDBConfig lets f change any setting of the CouchDB configuration
+// parsed from the connection URL.
+func WithCouchDBConfig(f func(*CouchDBConfig)) Option {
+	return func(o *options) { f(&o.couch) }
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"strings"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// hashVersions are the prefixes of the current versions of bcrypt hashes.
+// Hashes of older versions, such as "$2$", are replaced at the next login (see AuthUser).
+var hashVersions = []string{"$2a$", "$2b$", "$2y$"}
+
+// ChangePassword sets the password of a user, given their current password.
+// A wrong current password is an ErrUnauthorized error, checked before the new password:
+// a bad new password is an ErrInvalid error.
+// Outstanding password reset tokens of the user are revoked.
+func (db *DB) ChangePassword(userId, old, password string) error {
+	return db.ChangePasswordContext(context.Background(), userId, old, password)
+}
+
+// ChangePasswordContext is like ChangePassword but passes ctx down to every database request.
+func (db *DB) ChangePasswordContext(ctx context.Context, userId, old, password string) (err error) {
+	ctx, end := db.context(ctx, "change password")
+	defer end(&err)
+
+	var w user
+	if err := db.store.Get(ctx, userId, &w); err != nil {
+		return stack(err, "change password: cannot get user")
+	}
+	if w.Type != "user" {
+		return stack(ErrNotFound, "change password: user %q", userId)
+	}
+	// Authenticate before checking and hashing the new password
+	if bcrypt.CompareHashAndPassword([]byte(w.Password), []byte(old)) != nil {
+		return stack(ErrUnauthorized, "change password: wrong password")
+	}
+	if err := db.validatePassword(password, w.Name, w.Emails); err != nil {
+		return stack(err, "change password: bad password")
+	}
+	pwd, err := db.hashPassword(password)
+	if err != nil {
+		return stack(err, "change password")
+	}
+
+	// The password may have been changed meanwhile, or only rehashed
+	var wrong bool
+	_, err = db.updateUser(ctx, userId, func(u *user) bool {
+		wrong = u.Password != w.Password && bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(old)) != nil
+		if wrong {
+			return false
+		}
+		u.Password = pwd
+		return true
+	})
+	if err != nil {
+		return stack(err, "change password: cannot update user")
+	}
+	if wrong {
+		return stack(ErrUnauthorized, "change password: wrong password")
+	}
+	if err := db.revokeTokens(ctx, userId, func(t *token) bool { return t.Type == "reset" }); err != nil {
+		return stack(err, "change password: cannot revoke tokens")
+	}
+	return nil
+}
+
+// hashPassword hashes a password with the configured bcrypt cost.
+func (db *DB) hashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), db.cost())
+	if err != nil {
+		return "", stack(err, "failed to encrypt password")
+	}
+	return string(b), nil
+}
+
+// cost returns the bcrypt cost of new password hashes.
+func (db *DB) cost() int {
+	if db.bcryptCost < bcrypt.MinCost {
+		return bcrypt.DefaultCost
+	}
+	return db.bcryptCost
+}
+
+// outdated reports whether a bcrypt password hash should be replaced:
+// if it is of an older version, or if its cost is below the configured one.
+func (db *DB) outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false // not a bcrypt hash: it cannot be verified anyway
+	}
+	for _, v := range hashVersions {
+		if strings.HasPrefix(hash, v) {
+			return cost < db.cost()
+		}
+	}
+	return true
+}
+
+// upgradeHash replaces the outdated password hash of a user after a successful login.
+// Failing to is not an authentication failure: the error is reported
+// in the metrics, the span and the log of the operation, and it is tried again at the next login.
+func (db *DB) upgradeHash(ctx context.Context, u *user, password string) {
+	if !db.outdated(u.Password) {
+		return
+	}
+	err := db.rehash(ctx, u.Id, u.Password, password)
+	db.metrics.operation("rehash password", err)
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		if db.logger != nil {
+			db.logger.WarnContext(ctx, "cannot rehash password", "user", u.Id, "error", err)
+		}
+	}
+}
+
+// rehash replaces the outdated password hash of a user, given the password it matches.
+// It does nothing if the hash was changed meanwhile.
+func (db *DB) rehash(ctx context.Context, userId, hash, password string) error {
+	pwd, err := db.hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.updateUser(ctx, userId, func(u *user) bool {
+		if u.Password != hash {
+			return false
+		}
+		u.Password = pwd
+		return true
+	})
+	return err
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.crypto/bcrypt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestChangePassword(t *testing.T) {
+	db, _ := fixtureDB(t)
+	a, err := db.NewUser("Ann", "ann@example.com", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ChangePassword(a.Id, "wrong", "password2"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("wrong password: got %v, want ErrUnauthorized", err)
+	}
+	// The current password is checked first
+	if err := db.ChangePassword(a.Id, "wrong", "short"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("wrong password and bad password: got %v, want ErrUnauthorized", err)
+	}
+	if err := db.ChangePassword(a.Id, "password1", "short"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("bad password: got %v, want ErrInvalid", err)
+	}
+	if err := db.ChangePassword(a.Id, "password1", "password2"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, _ := db.AuthUser("ann@example.com", "password2"); !ok {
+		t.Error("cannot log in with the new password")
+	}
+}
+
+func TestOutdated(t *testing.T) {
+	db := NewWithStore(NewMemory(), WithBcryptCost(bcrypt.MinCost+1))
+	current := hashWithCost(t, "password1", bcrypt.MinCost+1)
+	for _, c := range []struct {
+		hash     string
+		outdated bool
+	}{
+		{current, false},
+		{"$2b$" + current[4:], false},
+		{"$2y$" + current[4:], false},
+		{"$2$" + current[4:], true},
+		{hashWithCost(t, "password1", bcrypt.MinCost), true},
+		{"plain text", false},
+	} {
+		if got := db.outdated(c.hash); got != c.outdated {
+			t.Errorf("%s: got outdated %v, want %v", c.hash, got, c.outdated)
+		}
+	}
+}
+
+func TestAuthUserRehash(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	old := NewWithStore(m, WithBcryptCost(bcrypt.MinCost))
+	a, err := old.NewUser("Ann", "ann@example.com", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	metrics := NewMetrics()
+	db := NewWithStore(m, WithBcryptCost(bcrypt.MinCost+1), WithMetrics(metrics),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	if ok, _, err := db.AuthUser("ann@example.com", "password1"); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	var u user
+	if err := m.Get(ctx, a.Id, &u); err != nil {
+		t.Fatal(err)
+	}
+	if cost, _ := bcrypt.Cost([]byte(u.Password)); cost != bcrypt.MinCost+1 {
+		t.Errorf("got cost %d after login, want %d", cost, bcrypt.MinCost+1)
+	}
+
+	// A failed rehash is counted and logged but does not fail the login
+	u.Password = hashWithCost(t, "password1", bcrypt.MinCost)
+	if _, err := m.Put(ctx, a.Id, &u); err != nil {
+		t.Fatal(err)
+	}
+	db.store = failingPut{m}
+	if ok, _, err := db.AuthUser("ann@example.com", "password1"); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if !strings.Contains(logs.String(), "cannot rehash password") {
+		t.Errorf("rehash failure not logged: %q", logs.String())
+	}
+	if n := testutil.ToFloat64(metrics.operations.WithLabelValues("rehash password", "error")); n != 1 {
+		t.Errorf("got %v failed rehashes, want 1", n)
+	}
+}
+
+// hashWithCost hashes a password with a bcrypt cost.
+func hashWithCost(t *testing.T, password string, cost int) string {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+// failingPut is a Store whose updates fail.
+type failingPut struct{ Store }
+
+func (failingPut) Put(ctx context.Context, id string, doc interface{}) (string, error) {
+	return "", errors.New("put failed")
+}
@@ -0,0 +1,216 @@
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxPasswordBytes is the length bcrypt truncates passwords at.
+const maxPasswordBytes = 72
+
+// minPersonal is the length of the shortest words of the name or email of a user
+// that passwords cannot contain (see PasswordPolicy.Personal).
+const minPersonal = 3
+
+// A PasswordPolicy tells which passwords users can choose (see WithPasswordPolicy).
+type PasswordPolicy struct {
+	MinLength int          // minimum number of characters, 8 if not positive
+	MaxLength int          // maximum number of bytes, at most (and by default) 72 since bcrypt ignores the rest
+	Lower     bool         // require a lowercase letter
+	Upper     bool         // require an uppercase letter
+	Digit     bool         // require a digit
+	Punct     bool         // require a punctuation mark or a symbol
+	Personal  bool         // reject passwords containing a word of the name or of an email of the user
+	Common    PasswordList // reject the passwords of a list, such as the most common or breached ones
+}
+
+// DefaultPasswordPolicy returns the password policy of a DB unless configured otherwise:
+// passwords must have at least 8 characters.
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{MinLength: 8}
+}
+
+// A PasswordViolation is a rule of a PasswordPolicy that a password breaks.
+type PasswordViolation int
+
+const (
+	PasswordTooShort PasswordViolation = iota // fewer characters than MinLength
+	PasswordTooLong                           // more bytes than MaxLength
+	PasswordNoLower                           // no lowercase letter
+	PasswordNoUpper                           // no uppercase letter
+	PasswordNoDigit                           // no digit
+	PasswordNoPunct                           // no punctuation mark or symbol
+	PasswordPersonal                          // contains the name or an email of the user
+	PasswordCommon                            // in the list of rejected passwords
+)
+
+func (v PasswordViolation) String() string {
+	switch v {
+	case PasswordTooShort:
+		return "too short"
+	case PasswordTooLong:
+		return "too long"
+	case PasswordNoLower:
+		return "no lowercase"
+	case PasswordNoUpper:
+		return "no uppercase"
+	case PasswordNoDigit:
+		return "no digit"
+	case PasswordNoPunct:
+		return "no punctuation"
+	case PasswordPersonal:
+		return "personal"
+	case PasswordCommon:
+		return "common"
+	}
+	return "unknown"
+}
+
+// A PasswordError lists all the rules of the password policy that a password breaks.
+// It is an ErrInvalid (errors.Is(err, ErrInvalid) holds),
+// and a ValidationError of the "password" field for errors.As.
+type PasswordError struct {
+	Violations []PasswordViolation
+	MinLength  int // of the policy, to explain PasswordTooShort
+	MaxLength  int // of the policy, to explain PasswordTooLong
+}
+
+func (e *PasswordError) Error() string { return "password " + e.msg() }
+
+func (e *PasswordError) Is(target error) bool { return target == ErrInvalid }
+
+func (e *PasswordError) As(target interface{}) bool {
+	v, ok := target.(**ValidationError)
+	if ok {
+		*v = &ValidationError{Field: "password", Msg: e.msg()}
+	}
+	return ok
+}
+
+// msg describes the violations, such as "is too short (min 8), has no digit".
+func (e *PasswordError) msg() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		switch v {
+		case PasswordTooShort:
+			msgs[i] = fmt.Sprintf("is too short (min %d)", e.MinLength)
+		case PasswordTooLong:
+			msgs[i] = fmt.Sprintf("is too long (max %d bytes)", e.MaxLength)
+		case PasswordNoLower:
+			msgs[i] = "has no lowercase letter"
+		case PasswordNoUpper:
+			msgs[i] = "has no uppercase letter"
+		case PasswordNoDigit:
+			msgs[i] = "has no digit"
+		case PasswordNoPunct:
+			msgs[i] = "has no punctuation"
+		case PasswordPersonal:
+			msgs[i] = "contains the name or email of the user"
+		case PasswordCommon:
+			msgs[i] = "is too common"
+		default:
+			msgs[i] = v.String()
+		}
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// check returns a PasswordError if a password breaks the policy
+// for a user of a name and emails, nil otherwise.
+func (p *PasswordPolicy) check(password, name string, emails []string) error {
+	min, max := p.MinLength, p.MaxLength
+	if min <= 0 {
+		min = DefaultPasswordPolicy().MinLength
+	}
+	if max <= 0 || max > maxPasswordBytes {
+		max = maxPasswordBytes
+	}
+	var lower, upper, digit, punct bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			punct = true
+		}
+	}
+
+	var vs []PasswordViolation
+	for _, c := range []struct {
+		broken    bool
+		violation PasswordViolation
+	}{
+		{utf8.RuneCountInString(password) < min, PasswordTooShort},
+		{len(password) > max, PasswordTooLong},
+		{p.Lower && !lower, PasswordNoLower},
+		{p.Upper && !upper, PasswordNoUpper},
+		{p.Digit && !digit, PasswordNoDigit},
+		{p.Punct && !punct, PasswordNoPunct},
+		{p.Personal && personal(password, name, emails), PasswordPersonal},
+		{p.Common.Contains(password), PasswordCommon},
+	} {
+		if c.broken {
+			vs = append(vs, c.violation)
+		}
+	}
+	if len(vs) == 0 {
+		return nil
+	}
+	return &PasswordError{Violations: vs, MinLength: min, MaxLength: max}
+}
+
+// personal reports whether a password contains, whatever the case, a word of a name
+// or of the local part of an email, of at least minPersonal characters.
+func personal(password, name string, emails []string) bool {
+	parts := []string{name}
+	for _, e := range emails {
+		if n := strings.LastIndex(e, "@"); n != -1 {
+			parts = append(parts, e[:n])
+		}
+	}
+	password = strings.ToLower(password)
+	for _, s := range parts {
+		words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, w := range words {
+			if utf8.RuneCountInString(w) >= minPersonal && strings.Contains(password, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A PasswordList is a set of passwords, regardless of case.
+type PasswordList map[string]struct{}
+
+// ReadPasswordList reads a list of passwords, one per line, such as a list of common or breached passwords.
+// Empty lines are skipped.
+func ReadPasswordList(r io.Reader) (PasswordList, error) {
+	l := make(PasswordList)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if p := strings.TrimSuffix(s.Text(), "\r"); p != "" {
+			l[strings.ToLower(p)] = struct{}{}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, stack(err, "cannot read password list")
+	}
+	return l, nil
+}
+
+// Contains reports whether a password is in the list, whatever its case.
+func (l PasswordList) Contains(password string) bool {
+	_, ok := l[strings.ToLower(password)]
+	return ok
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	common, err := ReadPasswordList(strings.NewReader("password1\r\n\nLetMeIn!\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PasswordPolicy{MinLength: 8, Lower: true, Upper: true, Digit: true, Punct: true, Personal: true, Common: common}
+	for _, c := range []struct {
+		password string
+		want     []PasswordViolation
+	}{
+		{"Tr0ub4dor&3", nil},
+		{"simonéé", []PasswordViolation{PasswordTooShort, PasswordNoUpper, PasswordNoDigit, PasswordNoPunct, PasswordPersonal}},
+		{"éééééééé", []PasswordViolation{PasswordNoUpper, PasswordNoDigit, PasswordNoPunct}}, // 8 characters, 16 bytes
+		{"LETMEIN!", []PasswordViolation{PasswordNoLower, PasswordNoDigit, PasswordCommon}},
+		{"x-Leblanc-1", []PasswordViolation{PasswordPersonal}},
+		{strings.Repeat("aA1!", 19), []PasswordViolation{PasswordTooLong}},
+	} {
+		err := p.check(c.password, "Simon Leblanc", []string{"sim.on@example.com"})
+		var got []PasswordViolation
+		var pe *PasswordError
+		if errors.As(err, &pe) {
+			got = pe.Violations
+		} else if err != nil {
+			t.Errorf("%q: got %v, want a PasswordError", c.password, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %v, want %v", c.password, got, c.want)
+		}
+	}
+}
+
+func TestPasswordError(t *testing.T) {
+	db := NewWithStore(NewMemory(), WithPasswordPolicy(PasswordPolicy{MinLength: 10, Digit: true}))
+	_, err := db.NewUser("Ann", "ann@example.com", "password")
+	if !errors.Is(err, ErrInvalid) {
+		t.Fatalf("got %v, want ErrInvalid", err)
+	}
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("got %v, want a ValidationError", err)
+	}
+	if ve.Field != "password" || ve.Msg != "is too short (min 10), has no digit" {
+		t.Errorf("got %q %q", ve.Field, ve.Msg)
+	}
+}
+
+func TestPasswordPolicyDefaultLength(t *testing.T) {
+	p := PasswordPolicy{Digit: true}
+	for _, password := range []string{"", "1", "1234567"} {
+		var pe *PasswordError
+		if err := p.check(password, "Ann", nil); !errors.As(err, &pe) || pe.Violations[0] != PasswordTooShort || pe.MinLength != 8 {
+			t.Errorf("%q: got %v, want too short (min 8)", password, err)
+		}
+	}
+	if err := p.check("12345678", "Ann", nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// defaultResetTTL is how long password reset tokens are valid unless configured otherwise.
+const defaultResetTTL = time.Hour
+
+// RequestPasswordReset creates a token to reset the password of the user owning an email address,
+// valid for an hour unless configured otherwise (see WithResetTTL),
+// and returns it so that it can be sent to the address.
+//
+// If no user owns the address (or only unverified, with WithVerifiedEmails),
+// it returns an empty token and no error: callers should answer the same in both cases,
+// so as not to reveal which addresses are registered.
+// For the same reason it then takes about as long as the last token it issued.
+func (db *DB) RequestPasswordReset(email string) (string, error) {
+	return db.RequestPasswordResetContext(context.Background(), email)
+}
+
+// RequestPasswordResetContext is like RequestPasswordReset but passes ctx down to every database request.
+func (db *DB) RequestPasswordResetContext(ctx context.Context, email string) (_ string, err error) {
+	ctx, end := db.context(ctx, "request password reset")
+	defer end(&err)
+
+	start := time.Now()
+	email = normalizeEmail(email)
+	id, err := db.emailOwner(ctx, email)
+	if err != nil {
+		return "", stack(err, "request password reset")
+	}
+	if id == "" {
+		return "", db.padReset(ctx, start) // User not found
+	}
+	var u user
+	if err := db.store.Get(ctx, id, &u); err != nil {
+		return "", stack(err, "request password reset: cannot get user")
+	}
+	if !contains(u.Emails, email) || db.verifiedOnly && !u.verified(email) {
+		return "", db.padReset(ctx, start) // Removed or unverified address
+	}
+
+	ttl := db.resetTTL
+	if ttl <= 0 {
+		ttl = defaultResetTTL
+	}
+	t := token{Type: "reset", User: u.Id, Email: email}
+	secret, err := db.issueToken(ctx, &t, ttl)
+	if err != nil {
+		return "", stack(err, "request password reset")
+	}
+	db.resetLatency.Store(int64(time.Since(start)))
+	return secret, nil
+}
+
+// padReset waits until a password reset request started at start has taken
+// as long as the last one issuing a token, so that both cannot be told apart.
+func (db *DB) padReset(ctx context.Context, start time.Time) error {
+	d := time.Duration(db.resetLatency.Load()) - time.Since(start)
+	if d <= 0 {
+		return nil
+	}
+	return stack(sleep(ctx, d), "request password reset")
+}
+
+// ResetPassword sets the password of the user of a reset token and returns the user.
+// A token can only be used once, and all the other tokens of the user,
+// email verifications included, are revoked.
+// Unknown or used tokens are ErrNotFound errors, expired ones and bad passwords ErrInvalid errors.
+// Tokens of an address removed from the user meanwhile are ErrNotFound errors.
+// The token is not used up by a bad password or a removed address, but it is
+// if the user then cannot be updated: a new one must be requested.
+func (db *DB) ResetPassword(token, password string) (*User, error) {
+	return db.ResetPasswordContext(context.Background(), token, password)
+}
+
+// ResetPasswordContext is like ResetPassword but passes ctx down to every database request.
+func (db *DB) ResetPasswordContext(ctx context.Context, token, password string) (_ *User, err error) {
+	ctx, end := db.context(ctx, "reset password")
+	defer end(&err)
+
+	t, err := db.getToken(ctx, "reset", token)
+	if err != nil {
+		return nil, stack(err, "reset password")
+	}
+	var w user
+	if err := db.store.Get(ctx, t.User, &w); err != nil {
+		return nil, stack(err, "reset password: cannot get user")
+	}
+	if !db.resettable(&w, t.Email) {
+		return nil, stack(ErrNotFound, "reset password: email %q was removed", t.Email)
+	}
+	if err := db.validatePassword(password, w.Name, w.Emails); err != nil {
+		return nil, stack(err, "reset password: bad password")
+	}
+	pwd, err := db.hashPassword(password)
+	if err != nil {
+		return nil, stack(err, "reset password")
+	}
+
+	// Only the update of the user may fail once the token is used up
+	if err := db.consumeToken(ctx, t); err != nil {
+		return nil, stack(err, "reset password")
+	}
+	var found bool
+	now := time.Now().UTC()
+	u, err := db.updateUser(ctx, t.User, func(u *user) bool {
+		if found = db.resettable(u, t.Email); !found {
+			return false // removed meanwhile
+		}
+		u.Password = pwd
+		u.Reset = &now
+		return true
+	})
+	if err != nil {
+		return nil, stack(err, "reset password: cannot update user")
+	}
+	if !found {
+		return nil, stack(ErrNotFound, "reset password: email %q was removed", t.Email)
+	}
+	if err := db.revokeTokens(ctx, t.User, nil); err != nil {
+		return nil, stack(err, "reset password: cannot revoke tokens")
+	}
+	return &User{Id: u.Id, Name: u.Name}, nil
+}
+
+// resettable reports whether the password of a user can be reset through an email address:
+// the address must still be theirs, and verified with WithVerifiedEmails.
+func (db *DB) resettable(u *user, email string) bool {
+	return contains(u.Emails, email) && (!db.verifiedOnly || u.verified(email))
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResetPassword(t *testing.T) {
+	db, _ := fixtureDB(t)
+	if _, err := db.NewUser("Ann", "ann@example.com", "password1"); err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := db.RequestPasswordReset("nobody@example.com"); tok != "" || err != nil {
+		t.Errorf("unknown address: got %q, %v, want no token and no error", tok, err)
+	}
+
+	t1, err := db.RequestPasswordReset("ann@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, err := db.RequestPasswordReset("ann@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ResetPassword(t1, "short"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("bad password: got %v, want ErrInvalid", err)
+	}
+	if _, err := db.ResetPassword(t1, "password2"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, _ := db.AuthUser("ann@example.com", "password2"); !ok {
+		t.Error("cannot log in with the new password")
+	}
+	if _, err := db.ResetPassword(t1, "password3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("used token: got %v, want ErrNotFound", err)
+	}
+	if _, err := db.ResetPassword(t2, "password3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoked token: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestResetPasswordRemovedEmail(t *testing.T) {
+	db, _ := fixtureDB(t)
+	a, err := db.NewUser("Ann", "ann@example.com", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddEmail(a.Id, "old@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := db.RequestPasswordReset("old@example.com")
+	if err != nil || tok == "" {
+		t.Fatal(tok, err)
+	}
+	if err := db.RemoveEmail(a.Id, "old@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ResetPassword(tok, "password2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("token of a removed address: got %v, want ErrNotFound", err)
+	}
+	if ok, _, _ := db.AuthUser("ann@example.com", "password2"); ok {
+		t.Error("password reset through a removed address")
+	}
+}
+
+func TestRequestPasswordResetTiming(t *testing.T) {
+	db, m := fixtureDB(t)
+	if _, err := db.NewUser("Ann", "ann@example.com", "password1"); err != nil {
+		t.Fatal(err)
+	}
+	const delay = 50 * time.Millisecond
+	db.store = slowPut{m, delay}
+
+	// Unknown addresses take as long as known ones, which write a token
+	start := time.Now()
+	if tok, err := db.RequestPasswordReset("ann@example.com"); tok == "" || err != nil {
+		t.Fatal(tok, err)
+	}
+	if d := time.Since(start); d < delay {
+		t.Fatalf("known address: took %v, want at least %v", d, delay)
+	}
+	start = time.Now()
+	if tok, err := db.RequestPasswordReset("nobody@example.com"); tok != "" || err != nil {
+		t.Fatal(tok, err)
+	}
+	if d := time.Since(start); d < delay {
+		t.Errorf("unknown address: took %v, want at least %v", d, delay)
+	}
+}
+
+func TestResetPasswordFailedUpdate(t *testing.T) {
+	db, m := fixtureDB(t)
+	if _, err := db.NewUser("Ann", "ann@example.com", "password1"); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := db.RequestPasswordReset("ann@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failure before the update leaves the token usable
+	if _, err := db.ResetPassword(tok, "short"); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("bad password: got %v, want ErrInvalid", err)
+	}
+	db.store = failingPut{m}
+	if _, err := db.ResetPassword(tok, "password2"); err == nil {
+		t.Fatal("reset despite the failed update")
+	}
+	db.store = m
+	if _, err := db.ResetPassword(tok, "password2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("token of a failed reset: got %v, want ErrNotFound", err)
+	}
+	if ok, _, _ := db.AuthUser("ann@example.com", "password1"); !ok {
+		t.Error("password changed by a failed reset")
+	}
+}
+
+// slowPut is a Store whose updates take some time.
+type slowPut struct {
+	Store
+	delay time.Duration
+}
+
+func (s slowPut) Put(ctx context.Context, id string, doc interface{}) (string, error) {
+	time.Sleep(s.delay)
+	return s.Store.Put(ctx, id, doc)
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A RetryPolicy tells how failed requests to CouchDB are retried.
+// Only idempotent requests (GET, HEAD, PUT of a document with a _rev and POST to _all_docs) are retried
+// after a transport error or a 5xx status; any request is retried after a 429 status.
+// The zero value disables retries.
+type RetryPolicy struct {
+	MaxRetries int           // maximum number of retries of a request
+	MinBackoff time.Duration // backoff before the first retry, 100ms if zero
+	MaxBackoff time.Duration // maximum backoff between retries, 5s if zero
+}
+
+// backoff returns a random delay before retry number n (starting at 0),
+// drawn from an exponentially growing interval (full jitter).
+// A Retry-After header given in seconds by the server takes precedence.
+func (p RetryPolicy) backoff(n int, res *http.Response) time.Duration {
+	min, max := p.MinBackoff, p.MaxBackoff
+	if min <= 0 {
+		min = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+	if res != nil {
+		if s, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && s >= 0 {
+			if d := time.Duration(s) * time.Second; d < max {
+				return d
+			}
+			return max
+		}
+	}
+	d := max
+	if n < 30 && min<<uint(n) < max {
+		d = min << uint(n)
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// idempotent reports whether a request can safely be sent twice.
+func idempotent(method, path string, body []byte) bool {
+	switch method {
+	case "GET", "HEAD":
+		return true
+	case "POST":
+		return strings.HasPrefix(path, "_all_docs")
+	case "PUT":
+		var d struct {
+			Rev string `json:"_rev"`
+		}
+		return json.NewDecoder(bytes.NewReader(body)).Decode(&d) == nil && d.Rev != ""
+	}
+	return false
+}
+
+// transient reports whether a request that got res or err may succeed if retried.
+func transient(idempotent bool, res *http.Response, err error) bool {
+	if err != nil {
+		return idempotent
+	}
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		return true
+	case res.StatusCode >= 500:
+		return idempotent
+	}
+	return false
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// defaultSessionTimeout is the default lifetime of a CouchDB session.
+const defaultSessionTimeout = 10 * time.Minute
+
+// sessionCookie is the name of the CouchDB session cookie.
+const sessionCookie = "AuthSession"
+
+// touch updates the expiry of the session from a response setting the session cookie.
+// The session is due for renewal after 90% of its lifetime.
+// The caller must hold db.mu.
+func (db *CouchDB) touch(r *http.Response) {
+	for _, c := range r.Cookies() {
+		if c.Name != sessionCookie {
+			continue
+		}
+		now := time.Now()
+		life := db.timeout
+		switch {
+		case c.MaxAge > 0:
+			life = time.Duration(c.MaxAge) * time.Second
+		case !c.Expires.IsZero():
+			life = c.Expires.Sub(now)
+		}
+		db.renewAt = now.Add(life * 9 / 10)
+	}
+}
+
+// refresh renews the session if it is about to expire.
+// It returns the number of the current session.
+func (db *CouchDB) refresh(ctx context.Context) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if time.Now().After(db.renewAt) {
+		if err := db.authenticate(ctx); err != nil {
+			return db.session, err
+		}
+	}
+	return db.session, nil
+}
+
+// renew opens a new session after the server rejected session number n.
+// Nothing is done if another request already renewed it.
+func (db *CouchDB) renew(ctx context.Context, n int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.session != n {
+		return nil
+	}
+	return db.authenticate(ctx)
+}
@@ -0,0 +1,101 @@
+package db
+
+import "context"
+
+// A View names one of the queries of the toople design document.
+type View string
+
+// The views of the toople design document (see couchdb/views).
+const (
+	ViewCircles      View = "circles"      // key: user, value: {_id: circle}
+	ViewMembers      View = "members"      // key: [circle, date], value: {_id: user}
+	ViewParticipants View = "participants" // key: [event, date], value: {_id: user}
+	ViewEvents       View = "events"       // key: circle, value: {_id: event}
+	ViewEmail        View = "email"        // key: email, value: null
+	ViewSlug         View = "slug"         // key: slug, value: null
+	ViewDismiss      View = "dismiss"      // key: user, value: what
+	ViewTokens       View = "tokens"       // key: user, value: type
+)
+
+// Dated reports whether the view is keyed by [id, date] rather than by id.
+// Dated views are queried by their first key element and sorted by date.
+func (v View) Dated() bool {
+	return v == ViewMembers || v == ViewParticipants
+}
+
+// A DocInfo holds the metadata of a document.
+type DocInfo struct {
+	Id      string
+	Rev     string // current revision, empty if the document never existed
+	Type    string // type of the document, such as "user" or "circle"
+	Deleted bool
+}
+
+// Exists reports whether the document exists and is not deleted.
+func (i DocInfo) Exists() bool {
+	return i.Rev != "" && !i.Deleted
+}
+
+// A BulkResult is the outcome of writing one document in a bulk request.
+type BulkResult struct {
+	Id  string
+	Rev string
+	Err error // nil if the document was written
+}
+
+// A Store is a backend holding the documents of the Toople database.
+// Documents are JSON-encodable values with "_id", "_rev" and "type" fields.
+// Every method must give up and return an error once its context is done.
+type Store interface {
+	// Get decodes the document with the given id into doc.
+	Get(ctx context.Context, id string, doc interface{}) error
+
+	// Create stores a new document and returns its generated id and revision.
+	Create(ctx context.Context, doc interface{}) (id, rev string, err error)
+
+	// CreateAll stores new documents in a single request and returns the outcome
+	// for each of them, in order. It is not atomic: some documents may be written
+	// while others fail. The error is only set if the request as a whole failed.
+	CreateAll(ctx context.Context, docs []interface{}) ([]BulkResult, error)
+
+	// Put creates or updates the document with the given id and returns its new revision.
+	// Updates must carry the current revision of the document.
+	Put(ctx context.Context, id string, doc interface{}) (rev string, err error)
+
+	// Delete removes the document with the given id and revision.
+	Delete(ctx context.Context, id, rev string) error
+
+	// Infos returns the metadata of documents, in the order of ids.
+	// Unknown documents have an empty revision.
+	Infos(ctx context.Context, ids []string) ([]DocInfo, error)
+
+	// Scan calls fn with every document of the store whose id sorts after the given one
+	// (all of them if after is empty), in id order. Design documents are skipped.
+	// It stops at the first error returned by fn.
+	Scan(ctx context.Context, after string, fn func(doc map[string]interface{}) error) error
+
+	// Query decodes the rows of a view matching key into out.
+	// The result has the shape of a CouchDB view response:
+	// a Rows field whose elements have Id, Key, Value and Doc fields,
+	// Doc being set only if includeDocs is true.
+	Query(ctx context.Context, view View, key string, includeDocs bool, out interface{}) error
+}
+
+// A Change is an entry of the changes feed of a store: the latest revision of a document.
+type Change struct {
+	Seq     string // sequence of the change, to resume the feed after it
+	Id      string
+	Deleted bool
+	Doc     map[string]interface{} // nil if the document is deleted
+}
+
+// A Feed is a Store whose changes can be followed, such as CouchDB and Memory.
+type Feed interface {
+	Store
+
+	// Changes returns the changes after the since sequence ("" for all of them,
+	// "now" for none so far) in order, and the sequence to pass next.
+	// If wait is true and there are no changes yet, it waits for some
+	// until ctx is done or the store gives up, returning none.
+	Changes(ctx context.Context, since string, wait bool) ([]Change, string, error)
+}
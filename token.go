@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// A token is a CouchDB document granting a single use of a secret sent to a user,
+// such as an email verification token.
+// Its id is the SHA-256 hash of the secret, which is never stored.
+type token struct {
+	Id      string    `json:"_id,omitempty"`
+	Rev     string    `json:"_rev,omitempty"`
+	Type    string    `json:"type"`
+	User    string    `json:"user"`
+	Email   string    `json:"email,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// tokenId returns the id of the token document of a secret.
+func tokenId(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueToken creates a token document valid for ttl and returns its secret.
+func (db *DB) issueToken(ctx context.Context, t *token, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", stack(err, "cannot generate token")
+	}
+	secret := hex.EncodeToString(b)
+	t.Id = tokenId(secret)
+	t.Expires = time.Now().Add(ttl).UTC()
+	if _, err := db.store.Put(ctx, t.Id, t); err != nil {
+		return "", stack(err, "cannot create token")
+	}
+	return secret, nil
+}
+
+// useToken returns the token document of a secret and deletes it, so that it cannot be used twice.
+// Unknown and used tokens are ErrNotFound errors, expired ones ErrInvalid errors.
+func (db *DB) useToken(ctx context.Context, typ, secret string) (*token, error) {
+	t, err := db.getToken(ctx, typ, secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.consumeToken(ctx, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// getToken returns the token document of a secret, without using it.
+func (db *DB) getToken(ctx context.Context, typ, secret string) (*token, error) {
+	var t token
+	if err := db.store.Get(ctx, tokenId(secret), &t); err != nil {
+		return nil, stack(err, "token")
+	}
+	if t.Type != typ {
+		return nil, stack(ErrNotFound, "token")
+	}
+	return &t, nil
+}
+
+// consumeToken deletes a token document, so that it cannot be used twice, and checks that it has not expired.
+func (db *DB) consumeToken(ctx context.Context, t *token) error {
+	if err := db.store.Delete(ctx, t.Id, t.Rev); errors.Is(err, ErrConflict) || errors.Is(err, ErrNotFound) {
+		return stack(ErrNotFound, "token already used")
+	} else if err != nil {
+		return stack(err, "cannot delete token")
+	}
+	if time.Now().After(t.Expires) {
+		return invalid("token", "has expired")
+	}
+	return nil
+}
+
+// revokeTokens deletes the outstanding tokens issued to a user that match,
+// or all of them if match is nil. Tokens used or revoked meanwhile are ignored.
+func (db *DB) revokeTokens(ctx context.Context, userId string, match func(t *token) bool) error {
+	var v struct{ Rows []struct{ Doc token } }
+	if err := db.store.Query(ctx, ViewTokens, userId, true, &v); err != nil {
+		return stack(err, "error querying tokens view")
+	}
+	for _, r := range v.Rows {
+		t := &r.Doc
+		if t.Rev == "" || match != nil && !match(t) {
+			continue
+		}
+		err := db.store.Delete(ctx, t.Id, t.Rev)
+		if err != nil && !errors.Is(err, ErrConflict) && !errors.Is(err, ErrNotFound) {
+			return stack(err, "cannot delete token")
+		}
+	}
+	return nil
+}
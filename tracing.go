@@ -0,0 +1,77 @@
+package db
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans of the package.
+const tracerName = "github.com/toople-co/toople-db"
+
+// tracer returns the tracer of tp, or of the global OpenTelemetry provider if tp is nil.
+func tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		return otel.Tracer(tracerName)
+	}
+	return tp.Tracer(tracerName)
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// requestSpan returns the name and attributes of the span of a request to the database
+// at a path relative to it, such as a view or a document.
+// Document ids only show up in attributes, to keep span names few.
+// Email addresses, such as the keys of the email view, are left out.
+func requestSpan(method, path string) (string, []attribute.KeyValue) {
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "couchdb"),
+		attribute.String("http.request.method", method),
+	}
+	p, query, _ := strings.Cut(path, "?")
+	switch kind, name := target("", "/"+p); kind {
+	case "view":
+		attrs = append(attrs, attribute.String("couchdb.view", name))
+		if key := viewKey(query); key != "" && View(name) != ViewEmail {
+			attrs = append(attrs, attribute.String("couchdb.key", key))
+		}
+		return "couchdb " + method + " " + name, attrs
+	case "endpoint":
+		return "couchdb " + method + " " + name, append(attrs, attribute.String("couchdb.endpoint", name))
+	case "doc":
+		if id, err := url.PathUnescape(name); err == nil {
+			name = id
+		}
+		return "couchdb " + method + " doc", append(attrs, attribute.String("couchdb.doc", redactId(name)))
+	}
+	return "couchdb " + method, attrs
+}
+
+// viewKey returns the key of a view query, such as the id of a circle,
+// from its key parameter or the first element of its startkey parameter.
+func viewKey(query string) string {
+	q, _ := url.ParseQuery(query)
+	var key interface{}
+	if k := q.Get("key"); k != "" {
+		json.Unmarshal([]byte(k), &key)
+	} else if k := q.Get("startkey"); k != "" {
+		var ks []interface{}
+		if json.Unmarshal([]byte(k), &ks) == nil && len(ks) > 0 {
+			key = ks[0]
+		}
+	}
+	s, _ := key.(string)
+	return s
+}
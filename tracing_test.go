@@ -0,0 +1,37 @@
+package db
+
+import (
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestRequestSpan(t *testing.T) {
+	for _, c := range []struct {
+		method, path string
+		name         string
+		attr         attribute.Key
+		value        string
+	}{
+		{"GET", "_design/toople/_view/circles?key=%22u0sim%22&include_docs=true", "couchdb GET circles", "couchdb.key", "u0sim"},
+		{"GET", `_design/toople/_view/members?startkey=["c0kus"]&endkey=["c0kus",{}]`, "couchdb GET members", "couchdb.key", "c0kus"},
+		{"GET", "_design/toople/_view/email?key=%22sim%40example.com%22", "couchdb GET email", "couchdb.key", ""},
+		{"GET", "u0sim", "couchdb GET doc", "couchdb.doc", "u0sim"},
+		{"PUT", "email:sim%40example.com", "couchdb PUT doc", "couchdb.doc", "email:" + redacted},
+		{"POST", "_bulk_docs", "couchdb POST _bulk_docs", "couchdb.endpoint", "_bulk_docs"},
+	} {
+		name, attrs := requestSpan(c.method, c.path)
+		if name != c.name {
+			t.Errorf("%s %s: got span %q, want %q", c.method, c.path, name, c.name)
+		}
+		var value string
+		for _, a := range attrs {
+			if a.Key == c.attr {
+				value = a.Value.AsString()
+			}
+		}
+		if value != c.value {
+			t.Errorf("%s %s: got %s %q, want %q", c.method, c.path, c.attr, value, c.value)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
+
+// A unit is a unit of work: it records the documents created during an operation
+// so that they can be deleted if a later step fails.
+// Callers thereby never see part of the documents of an operation.
+type unit struct {
+	db      *DB
+	ctx     context.Context
+	created []BulkResult
+}
+
+// begin starts a unit of work.
+func (db *DB) begin(ctx context.Context) *unit {
+	return &unit{db: db, ctx: ctx}
+}
+
+// create creates a document and returns its id.
+func (u *unit) create(doc interface{}) (string, error) {
+	id, rev, err := u.db.store.Create(u.ctx, doc)
+	if err != nil {
+		return "", err
+	}
+	u.created = append(u.created, BulkResult{Id: id, Rev: rev})
+	return id, nil
+}
+
+// createAll creates documents in a single request to the store.
+// It fails if any of them cannot be created.
+func (u *unit) createAll(docs []interface{}) error {
+	res, err := u.db.store.CreateAll(u.ctx, docs)
+	if err != nil {
+		return err
+	}
+	for _, r := range res {
+		if r.Err == nil {
+			u.created = append(u.created, r)
+		}
+	}
+	for _, r := range res {
+		if r.Err != nil {
+			return stack(r.Err, "document %q", r.Id)
+		}
+	}
+	return nil
+}
+
+// abort deletes the documents created so far, most recent first, and returns err
+// along with the errors of the deletions, if any.
+// Documents are deleted even if the context of the unit is done.
+func (u *unit) abort(err error) error {
+	ctx := context.WithoutCancel(u.ctx)
+	for i := len(u.created) - 1; i >= 0; i-- {
+		d := u.created[i]
+		if e := u.db.store.Delete(ctx, d.Id, d.Rev); e != nil {
+			err = errors.Join(err, stack(e, "cannot clean up %q", d.Id))
+		}
+	}
+	u.created = nil
+	return err
+}
+
+// uuid returns a random document id in the format of CouchDB.
+func uuid() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
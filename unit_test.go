@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// docCount returns the number of documents of a Memory store.
+func docCount(t *testing.T, m *Memory) int {
+	t.Helper()
+	n := 0
+	if err := m.Scan(context.Background(), "", func(map[string]interface{}) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// failingType is a Memory store failing to create the documents of a type.
+type failingType struct {
+	*Memory
+	typ string
+}
+
+var errCreate = errors.New("create failed")
+
+func (f failingType) Create(ctx context.Context, doc interface{}) (string, string, error) {
+	if d, err := toMap(doc); err == nil && d["type"] == f.typ {
+		return "", "", errCreate
+	}
+	return f.Memory.Create(ctx, doc)
+}
+
+func (f failingType) CreateAll(ctx context.Context, docs []interface{}) ([]BulkResult, error) {
+	res := make([]BulkResult, len(docs))
+	for i, doc := range docs {
+		res[i].Id, res[i].Rev, res[i].Err = f.Create(ctx, doc)
+	}
+	return res, nil
+}
+
+func TestNewCircleRollback(t *testing.T) {
+	db, m := fixtureDB(t)
+	n := docCount(t, m)
+	db.store = failingType{m, "member"}
+	if _, err := db.NewCircle("Bobs", "bobs", "u0sim"); !errors.Is(err, errCreate) {
+		t.Fatalf("got %v, want the failure of the member", err)
+	}
+	if got := docCount(t, m); got != n {
+		t.Errorf("got %d documents, want the %d before", got, n)
+	}
+
+	// The slug of the circle rolled back is free
+	db.store = m
+	if _, err := db.NewCircle("Bobs", "bobs", "u0sim"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewUserRollback(t *testing.T) {
+	db, m := fixtureDB(t)
+	n := docCount(t, m)
+	db.store = failingType{m, "user"}
+	if _, err := db.NewUser("Bob", "bob@example.com", "password1"); !errors.Is(err, errCreate) {
+		t.Fatalf("got %v, want the failure of the user", err)
+	}
+	if got := docCount(t, m); got != n {
+		t.Errorf("got %d documents, want the %d before", got, n)
+	}
+
+	// The email claimed before the failure is released
+	db.store = m
+	if _, err := db.NewUser("Bob", "bob@example.com", "password1"); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,15 +1,13 @@
 package db
 
 import (
+	"context"
 	"fmt"
-	"net/http"
 	"sort"
 	"strings"
 	"time"
-	// "unicode"
 
 	"code.google.com/p/go.crypto/bcrypt"
-	"github.com/simleb/errors"
 )
 
 // A User is a proxy for a full user document in the database.
@@ -20,74 +18,84 @@ type User struct {
 
 // A user is a CouchDB user document.
 type user struct {
-	Id       string   `json:"_id,omitempty"`
-	Rev      string   `json:"_rev,omitempty"`
-	Type     string   `json:"type"`
-	Name     string   `json:"name"`
-	Emails   []string `json:"emails"`
-	Password string   `json:"password"`
+	Id       string               `json:"_id,omitempty"`
+	Rev      string               `json:"_rev,omitempty"`
+	Type     string               `json:"type"`
+	Name     string               `json:"name"`
+	Emails   []string             `json:"emails"`             // the first one is the primary address
+	Verified map[string]time.Time `json:"verified,omitempty"` // verification time of addresses
+	Password string               `json:"password"`
+	Reset    *time.Time           `json:"reset,omitempty"` // time of the last password reset
 }
 
 // NewUser creates a new user in the database with a name, email and password.
+// The email becomes the primary address of the user (see AddEmail for more).
 // The name cannot be empty.
 // The email must contain "@".
-// The password must have at least 8 characters.
+// The password must satisfy the password policy (see WithPasswordPolicy).
 func (db *DB) NewUser(name, email, password string) (*User, error) {
+	return db.NewUserContext(context.Background(), name, email, password)
+}
+
+// NewUserContext is like NewUser but passes ctx down to every database request.
+func (db *DB) NewUserContext(ctx context.Context, name, email, password string) (_ *User, err error) {
+	ctx, end := db.context(ctx, "new user")
+	defer end(&err)
+
 	// Validate fields
+	email = normalizeEmail(email)
 	if err := validateName(name); err != nil {
-		return nil, errors.Stack(err, "new user: bad name")
+		return nil, stack(err, "new user: bad name")
 	}
 	if err := validateEmail(email); err != nil {
-		return nil, errors.Stack(err, "new user: bad email")
+		return nil, stack(err, "new user: bad email")
 	}
-	if err := validatePassword(password); err != nil {
-		return nil, errors.Stack(err, "new user: bad password")
+	if err := db.validatePassword(password, name, []string{email}); err != nil {
+		return nil, stack(err, "new user: bad password")
 	}
 
 	// Check if email is available
-	var v struct{ Rows []struct{} }
-	s, err := db.get(db.view("email", email, false), &v)
+	owner, err := db.emailOwner(ctx, email)
 	if err != nil {
-		return nil, errors.Stack(err, "new user: error querying email view")
-	}
-	if s != http.StatusOK {
-		return nil, fmt.Errorf("new user: database error")
+		return nil, stack(err, "new user")
 	}
-	if len(v.Rows) > 0 {
-		return nil, fmt.Errorf("new user: email not available")
+	if owner != "" {
+		return nil, stack(ErrEmailTaken, "new user")
 	}
 
 	// Encrypt password
-	pwd, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	pwd, err := db.hashPassword(password)
 	if err != nil {
-		return nil, errors.Stack(err, "new user: failed to encrypt password")
+		return nil, stack(err, "new user")
 	}
 
-	u := user{
+	d := user{
+		Id:       uuid(),
 		Type:     "user",
 		Name:     name,
 		Emails:   []string{email},
-		Password: string(pwd),
+		Password: pwd,
 	}
 
-	// Create document in database
-	var r struct{ Id string }
-	s, err = db.post("", &u, &r)
-	if err != nil {
-		return nil, errors.Stack(err, "new user: cannot post document")
+	// Claim the email, which fails if a concurrent registration claimed it first,
+	// then create document in database
+	u := db.begin(ctx)
+	if err := u.claimEmail(email, d.Id); err != nil {
+		return nil, stack(err, "new user")
 	}
-	if s != http.StatusCreated {
-		return nil, fmt.Errorf("new user: db post error (status %d)", s)
+	id, err := u.create(&d)
+	if err != nil {
+		return nil, u.abort(stack(err, "new user: cannot post document"))
 	}
 
-	return &User{Id: r.Id, Name: name}, nil
+	return &User{Id: id, Name: name}, nil
 }
 
 // validateName returns nil when a name is valid.
 // Currently, a name is valid if it is not empty.
 func validateName(name string) error {
 	if name == "" {
-		return fmt.Errorf("validate name: empty")
+		return invalid("name", "is empty")
 	}
 	return nil
 }
@@ -96,57 +104,43 @@ func validateName(name string) error {
 // Currently, an email is valid if it contains "@".
 func validateEmail(email string) error {
 	if !strings.Contains(email, "@") {
-		return fmt.Errorf("validate email: @ missing")
+		return invalid("email", "has no @")
 	}
 	return nil
 }
 
-// validatePassword returns nil if a password is valid.
-// Currently, a password is valid if it contains at least 8 characters.
-func validatePassword(password string) error {
-	if len(password) < 8 {
-		return fmt.Errorf("validate password: too short (min 8)")
-	}
-	// lower, upper, digit, punct := false, false, false, false
-	// for _, r := range password {
-	// 	switch {
-	// 	case unicode.IsLower(r):
-	// 		lower = true
-	// 	case unicode.IsUpper(r):
-	// 		upper = true
-	// 	case unicode.IsDigit(r):
-	// 		digit = true
-	// 	case unicode.IsPunct(r):
-	// 		punct = true
-	// 	}
-	// }
-	// switch {
-	// case !lower:
-	// 	return fmt.Errorf("validate password: must contain lowercase")
-	// case !upper:
-	// 	return fmt.Errorf("validate password: must contain uppercase")
-	// case !digit:
-	// 	return fmt.Errorf("validate password: must contain digits")
-	// case !punct:
-	// 	return fmt.Errorf("validate password: must contain punctuation")
-	// }
-	return nil
+// validatePassword returns nil if a password satisfies the password policy
+// for a user of a name and emails, and a *PasswordError otherwise.
+func (db *DB) validatePassword(password, name string, emails []string) error {
+	return db.passwords.check(password, name, emails)
 }
 
-// AuthUser tries to authenticate a user from an email and a password.
+// AuthUser tries to authenticate a user from any of their emails and a password.
+// With WithVerifiedEmails, unverified emails are ignored.
 // It returns true only if authentication is successful.
 // It returns the user matching the email or nil if none is found, even if authentication fails.
+// On success, a password hash of a lower cost than configured (see WithBcryptCost)
+// or of an older bcrypt version is replaced.
 func (db *DB) AuthUser(email, password string) (bool, *User, error) {
+	return db.AuthUserContext(context.Background(), email, password)
+}
+
+// AuthUserContext is like AuthUser but passes ctx down to every database request.
+func (db *DB) AuthUserContext(ctx context.Context, email, password string) (ok bool, _ *User, err error) {
+	ctx, end := db.context(ctx, "auth user")
+	defer end(&err)
+	defer func() {
+		if err == nil {
+			db.metrics.auth(ok)
+		}
+	}()
+
 	email = normalizeEmail(email)
 
 	// Find user doc from email
 	var v struct{ Rows []struct{ Doc user } }
-	s, err := db.get(db.view("email", email, true), &v)
-	if err != nil {
-		return false, nil, errors.Stack(err, "auth user: error querying email view")
-	}
-	if s != http.StatusOK {
-		return false, nil, fmt.Errorf("auth user: database error")
+	if err := db.store.Query(ctx, ViewEmail, email, true, &v); err != nil {
+		return false, nil, stack(err, "auth user: error querying email view")
 	}
 	if len(v.Rows) == 0 {
 		return false, nil, nil // User not found
@@ -154,10 +148,16 @@ func (db *DB) AuthUser(email, password string) (bool, *User, error) {
 
 	// Compare hashed passwords
 	w := v.Rows[0].Doc
+	if db.verifiedOnly && !w.verified(email) {
+		return false, nil, nil // Unverified address
+	}
 	u := &User{Id: w.Id, Name: w.Name}
 	if err := bcrypt.CompareHashAndPassword([]byte(w.Password), []byte(password)); err != nil {
 		return false, u, nil
 	}
+
+	// Upgrade the hash while the password is at hand
+	db.upgradeHash(ctx, &w, password)
 	return true, u, nil
 }
 
@@ -196,14 +196,19 @@ func (b ByDate) Less(i, j int) bool { return b[i].Date().After(b[j].Date()) }
 
 // GetNotifications returns the notifications of a user sorted by descending date.
 func (db *DB) GetNotifications(userId string) ([]Notification, error) {
+	return db.GetNotificationsContext(context.Background(), userId)
+}
+
+// GetNotificationsContext is like GetNotifications but passes ctx down to every database request.
+// It stops querying the database as soon as ctx is done.
+func (db *DB) GetNotificationsContext(ctx context.Context, userId string) (_ []Notification, err error) {
+	ctx, end := db.context(ctx, "get notifications")
+	defer end(&err)
+
 	// Get list of circles
 	var vc struct{ Rows []struct{ Doc circle } }
-	s, err := db.get(db.view("circles", userId, true), &vc)
-	if err != nil {
-		return nil, errors.Stack(err, "get feed: error querying circles view")
-	}
-	if s != http.StatusOK {
-		return nil, fmt.Errorf("get feed: db get circles view error (status %d)", s)
+	if err := db.store.Query(ctx, ViewCircles, userId, true, &vc); err != nil {
+		return nil, stack(err, "get feed: error querying circles view")
 	}
 	if len(vc.Rows) == 0 {
 		return nil, nil
@@ -211,12 +216,8 @@ func (db *DB) GetNotifications(userId string) ([]Notification, error) {
 
 	// Get user's dismissed notifications
 	var vd struct{ Rows []struct{ Value string } }
-	s, err = db.get(db.view("dismiss", userId, false), &vd)
-	if err != nil {
-		return nil, errors.Stack(err, "get feed: error querying dismiss view")
-	}
-	if s != http.StatusOK {
-		return nil, fmt.Errorf("get feed: db get dismiss view error (status %d)", s)
+	if err := db.store.Query(ctx, ViewDismiss, userId, false, &vd); err != nil {
+		return nil, stack(err, "get feed: error querying dismiss view")
 	}
 	skip := make(map[string]struct{})
 	for _, r := range vd.Rows {
@@ -230,12 +231,8 @@ func (db *DB) GetNotifications(userId string) ([]Notification, error) {
 	for _, rc := range vc.Rows {
 		// Get list of events
 		var ve struct{ Rows []struct{ Doc event } }
-		s, err := db.get(db.view("events", rc.Doc.Id, true), &ve)
-		if err != nil {
-			return nil, errors.Stack(err, "get feed: error querying events view")
-		}
-		if s != http.StatusOK {
-			return nil, fmt.Errorf("get feed: db get events view error (status %d)", s)
+		if err := db.store.Query(ctx, ViewEvents, rc.Doc.Id, true, &ve); err != nil {
+			return nil, stack(err, "get feed: error querying events view")
 		}
 		for _, re := range ve.Rows {
 			if _, ok := m[re.Doc.Id]; !ok {
@@ -251,12 +248,8 @@ func (db *DB) GetNotifications(userId string) ([]Notification, error) {
 				Doc user
 			}
 		}
-		s, err = db.get(db.dateView("members", rc.Doc.Id, true), &vu)
-		if err != nil {
-			return nil, errors.Stack(err, "get feed: error querying members view")
-		}
-		if s != http.StatusOK {
-			return nil, fmt.Errorf("get feed: db get members view error (status %d)", s)
+		if err := db.store.Query(ctx, ViewMembers, rc.Doc.Id, true, &vu); err != nil {
+			return nil, stack(err, "get feed: error querying members view")
 		}
 		for _, ru := range vu.Rows {
 			if _, ok := skip[ru.Id]; ok {
@@ -289,65 +282,11 @@ func (db *DB) GetNotifications(userId string) ([]Notification, error) {
 		if _, ok := skip[id]; ok {
 			continue
 		}
-		// Get list of participants
-		var v struct {
-			Rows []struct {
-				Key []string
-				Doc user
-			}
-		}
-		s, err := db.get(db.dateView("participants", id, true), &v)
+		ev, err := db.eventNotification(ctx, e)
 		if err != nil {
-			return nil, errors.Stack(err, "get feed: error querying participants view")
+			return nil, stack(err, "get feed")
 		}
-		if s != http.StatusOK {
-			return nil, fmt.Errorf("get feed: db get participants view error (status %d)", s)
-		}
-		if len(v.Rows) == 0 {
-			return nil, fmt.Errorf("get feed: db inconsistent: event with no participants")
-		}
-		p := make([]Participant, len(v.Rows))
-		np := 0
-		for i, r := range v.Rows {
-			date, err := time.Parse(time.RFC3339, r.Key[1])
-			if err != nil {
-				return nil, fmt.Errorf("get feed: error parsing date")
-			}
-			p[i] = Participant{
-				Id:   r.Doc.Id,
-				Name: r.Doc.Name,
-				Date: date,
-			}
-			if p[i].Date.Before(e.Date) {
-				np++
-			}
-		}
-		var status string
-		if np >= e.Threshold {
-			status = "Confirmed"
-		} else {
-			if e.Date.Before(time.Now()) {
-				status = "Cancelled"
-			} else {
-				status = "Pending"
-			}
-		}
-		ev := Event{
-			Id:        e.Id,
-			Location:  e.Location,
-			Title:     e.Title,
-			Info:      e.Info,
-			Date:      e.Date,
-			Threshold: e.Threshold,
-			Creator: User{
-				Id:   p[0].Id,
-				Name: p[0].Name,
-			},
-			Created:      p[0].Date,
-			Status:       status,
-			Participants: p,
-		}
-		n = append(n, Notification{Event: &ev})
+		n = append(n, Notification{Event: ev})
 	}
 
 	// Optionally, group similar notification (Amin and 3 others joined your circle…)
@@ -358,6 +297,64 @@ func (db *DB) GetNotifications(userId string) ([]Notification, error) {
 	return n, nil
 }
 
+// eventNotification returns the notification of an event, with its participants and status.
+func (db *DB) eventNotification(ctx context.Context, e event) (*Event, error) {
+	// Get list of participants
+	var v struct {
+		Rows []struct {
+			Key []string
+			Doc user
+		}
+	}
+	if err := db.store.Query(ctx, ViewParticipants, e.Id, true, &v); err != nil {
+		return nil, stack(err, "error querying participants view")
+	}
+	if len(v.Rows) == 0 {
+		return nil, stack(ErrNotFound, "db inconsistent: event %q with no participants", e.Id)
+	}
+	p := make([]Participant, len(v.Rows))
+	np := 0
+	for i, r := range v.Rows {
+		date, err := time.Parse(time.RFC3339, r.Key[1])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing date")
+		}
+		p[i] = Participant{
+			Id:   r.Doc.Id,
+			Name: r.Doc.Name,
+			Date: date,
+		}
+		if p[i].Date.Before(e.Date) {
+			np++
+		}
+	}
+	var status string
+	if np >= e.Threshold {
+		status = "Confirmed"
+	} else {
+		if e.Date.Before(time.Now()) {
+			status = "Cancelled"
+		} else {
+			status = "Pending"
+		}
+	}
+	return &Event{
+		Id:        e.Id,
+		Location:  e.Location,
+		Title:     e.Title,
+		Info:      e.Info,
+		Date:      e.Date,
+		Threshold: e.Threshold,
+		Creator: User{
+			Id:   p[0].Id,
+			Name: p[0].Name,
+		},
+		Created:      p[0].Date,
+		Status:       status,
+		Participants: p,
+	}, nil
+}
+
 // A dismiss is a CouchDB dismiss document.
 type dismiss struct {
 	Id   string `json:"_id,omitempty"`
@@ -370,17 +367,21 @@ type dismiss struct {
 // DismissFeedEntry creates a dismiss document in the database
 // so that the notification disappears from the user's home page.
 func (db *DB) DismissFeedEntry(id, userId string) error {
+	return db.DismissFeedEntryContext(context.Background(), id, userId)
+}
+
+// DismissFeedEntryContext is like DismissFeedEntry but passes ctx down to every database request.
+func (db *DB) DismissFeedEntryContext(ctx context.Context, id, userId string) (err error) {
+	ctx, end := db.context(ctx, "dismiss")
+	defer end(&err)
+
 	d := dismiss{
 		Type: "dismiss",
 		User: userId,
 		What: id,
 	}
-	s, err := db.post("", &d, nil)
-	if err != nil {
-		return errors.Stack(err, "dismiss: database error")
-	}
-	if s != http.StatusCreated {
-		return fmt.Errorf("dismiss: got status %d trying to create dismiss", s)
+	if _, _, err := db.store.Create(ctx, &d); err != nil {
+		return stack(err, "dismiss: database error")
 	}
 	return nil
 }
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestNewUserEmailTaken(t *testing.T) {
+	db, _ := fixtureDB(t)
+
+	// Users of the fixtures have no email claims
+	if _, err := db.NewUser("Sim", "sleblanc@princeton.edu", "password1"); !errors.Is(err, ErrEmailTaken) {
+		t.Fatalf("got %v, want ErrEmailTaken", err)
+	}
+
+	// Concurrent registrations
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = db.NewUser("Bob", "bob@example.com", "password1")
+		}(i)
+	}
+	wg.Wait()
+	created := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrEmailTaken):
+			t.Errorf("got %v, want ErrEmailTaken", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d users created with the same email, want 1", created)
+	}
+	if ids := viewIds(t, db.store, ViewEmail, "bob@example.com"); len(ids) != 1 {
+		t.Errorf("got users %v for the email, want 1", ids)
+	}
+}
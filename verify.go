@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// defaultVerificationTTL is how long verification tokens are valid unless configured otherwise.
+const defaultVerificationTTL = 48 * time.Hour
+
+// IssueVerification creates a token to verify an email address of a user,
+// valid for 48 hours unless configured otherwise (see WithVerificationTTL),
+// and returns it so that it can be sent to the address.
+func (db *DB) IssueVerification(userId, email string) (string, error) {
+	return db.IssueVerificationContext(context.Background(), userId, email)
+}
+
+// IssueVerificationContext is like IssueVerification but passes ctx down to every database request.
+func (db *DB) IssueVerificationContext(ctx context.Context, userId, email string) (_ string, err error) {
+	ctx, end := db.context(ctx, "issue verification")
+	defer end(&err)
+
+	email = normalizeEmail(email)
+	var u user
+	if err := db.store.Get(ctx, userId, &u); err != nil {
+		return "", stack(err, "issue verification: cannot get user")
+	}
+	if u.Type != "user" || !contains(u.Emails, email) {
+		return "", stack(ErrNotFound, "issue verification: email %q of user %q", email, userId)
+	}
+	if u.verified(email) {
+		return "", stack(invalid("email", "is already verified"), "issue verification")
+	}
+
+	ttl := db.verificationTTL
+	if ttl <= 0 {
+		ttl = defaultVerificationTTL
+	}
+	t := token{Type: "verification", User: userId, Email: email}
+	secret, err := db.issueToken(ctx, &t, ttl)
+	if err != nil {
+		return "", stack(err, "issue verification")
+	}
+	return secret, nil
+}
+
+// VerifyEmail marks the email address of a verification token as verified
+// and returns its user. A token can only be used once.
+// Unknown or used tokens are ErrNotFound errors, expired ones ErrInvalid errors.
+func (db *DB) VerifyEmail(token string) (*User, error) {
+	return db.VerifyEmailContext(context.Background(), token)
+}
+
+// VerifyEmailContext is like VerifyEmail but passes ctx down to every database request.
+func (db *DB) VerifyEmailContext(ctx context.Context, token string) (_ *User, err error) {
+	ctx, end := db.context(ctx, "verify email")
+	defer end(&err)
+
+	t, err := db.useToken(ctx, "verification", token)
+	if err != nil {
+		return nil, stack(err, "verify email")
+	}
+	var found bool
+	u, err := db.updateUser(ctx, t.User, func(u *user) bool {
+		found = contains(u.Emails, t.Email)
+		if !found || u.verified(t.Email) {
+			return false
+		}
+		if u.Verified == nil {
+			u.Verified = make(map[string]time.Time)
+		}
+		u.Verified[t.Email] = time.Now().UTC()
+		return true
+	})
+	if err != nil {
+		return nil, stack(err, "verify email: cannot update user")
+	}
+	if !found {
+		return nil, stack(ErrNotFound, "verify email: email %q was removed", t.Email)
+	}
+	return &User{Id: u.Id, Name: u.Name}, nil
+}
+
+// verified reports whether an email address of the user was verified.
+func (u *user) verified(email string) bool {
+	_, ok := u.Verified[email]
+	return ok
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifyEmail(t *testing.T) {
+	_, m := fixtureDB(t)
+	db := NewWithStore(m, WithVerifiedEmails())
+	a, err := db.NewUser("Ann", "ann@example.com", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, _ := db.AuthUser("ann@example.com", "password1"); ok {
+		t.Fatal("logged in with an unverified address")
+	}
+	if _, err := db.IssueVerification(a.Id, "other@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("address not of the user: got %v, want ErrNotFound", err)
+	}
+
+	tok, err := db.IssueVerification(a.Id, "ann@Example.COM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := db.VerifyEmail(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Id != a.Id {
+		t.Errorf("got user %q, want %q", u.Id, a.Id)
+	}
+	if ok, _, _ := db.AuthUser("ann@example.com", "password1"); !ok {
+		t.Error("cannot log in with a verified address")
+	}
+
+	// Tokens are single use, and verified addresses get no new ones
+	if _, err := db.VerifyEmail(tok); !errors.Is(err, ErrNotFound) {
+		t.Errorf("used token: got %v, want ErrNotFound", err)
+	}
+	if _, err := db.IssueVerification(a.Id, "ann@example.com"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("verified address: got %v, want ErrInvalid", err)
+	}
+}
+
+func TestVerifyEmailExpired(t *testing.T) {
+	_, m := fixtureDB(t)
+	db := NewWithStore(m, WithVerifiedEmails(), WithVerificationTTL(time.Millisecond))
+	a, err := db.NewUser("Ann", "ann@example.com", "password1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := db.IssueVerification(a.Id, "ann@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := db.VerifyEmail(tok); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expired token: got %v, want ErrInvalid", err)
+	}
+	if ok, _, _ := db.AuthUser("ann@example.com", "password1"); ok {
+		t.Error("address verified by an expired token")
+	}
+	if _, err := db.VerifyEmail(tok); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired token used again: got %v, want ErrNotFound", err)
+	}
+}
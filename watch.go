@@ -0,0 +1,285 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// A DeltaKind tells how the notifications of a user changed.
+type DeltaKind int
+
+const (
+	DeltaAdded     DeltaKind = iota // a notification appeared
+	DeltaUpdated                    // an event changed or got a new participant
+	DeltaDismissed                  // the user dismissed a notification
+)
+
+func (k DeltaKind) String() string {
+	switch k {
+	case DeltaAdded:
+		return "added"
+	case DeltaUpdated:
+		return "updated"
+	case DeltaDismissed:
+		return "dismissed"
+	}
+	return "unknown"
+}
+
+// A Delta is a change of the notifications returned by GetNotifications.
+type Delta struct {
+	Kind         DeltaKind
+	Id           string       // id of the notification: the event or the member document
+	Notification Notification // the notification as it now is, unless dismissed
+	Seq          string       // sequence of the change, to resume watching after it
+}
+
+// Watch follows the changes feed of the database and sends on ch the changes
+// of the notifications of a user: new members of their circles (the user joining a circle included),
+// events posted to their circles and their new participants, and dismissed notifications.
+// Dismissed notifications are not sent again, and deleted documents are ignored.
+//
+// Watching starts after the since sequence, typically the Seq of the last delta handled
+// before reconnecting, or with the changes to come if since is empty.
+// Deltas may repeat notifications already returned by GetNotifications: they are identified by Id.
+//
+// Changes referring to documents that no longer exist, such as the invitation to an event
+// rolled back meanwhile, are skipped (and logged with WithLogger): resuming after them
+// must not fail on them again.
+//
+// Watch blocks until ctx is done or the changes feed fails, and returns the error.
+// The store must implement Feed.
+func (db *DB) Watch(ctx context.Context, userId, since string, ch chan<- Delta) error {
+	ctx = withOp(ctx, "watch") // no span: watching lasts as long as ctx
+	f, ok := db.store.(Feed)
+	if !ok {
+		return errors.New("watch: store has no changes feed")
+	}
+	if since == "" {
+		_, now, err := f.Changes(ctx, "now", false)
+		if err != nil {
+			return stack(err, "watch: cannot get changes")
+		}
+		since = now
+	}
+
+	w := &watcher{
+		db:      db,
+		user:    userId,
+		circles: make(map[string]circle),
+		events:  make(map[string]struct{}),
+		skip:    make(map[string]struct{}),
+	}
+	if err := w.load(ctx); err != nil {
+		return stack(err, "watch")
+	}
+
+	for {
+		changes, next, err := f.Changes(ctx, since, true)
+		if err != nil {
+			return stack(err, "watch: cannot get changes")
+		}
+		for _, c := range changes {
+			d, ok, err := w.delta(ctx, c)
+			if errors.Is(err, ErrNotFound) {
+				if db.logger != nil {
+					db.logger.WarnContext(ctx, "watch: skipping change", "doc", c.Id, "seq", c.Seq, "error", err)
+				}
+				continue
+			}
+			if err != nil {
+				return stack(err, "watch: change of %q", c.Id)
+			}
+			if !ok {
+				continue
+			}
+			select {
+			case ch <- d:
+			case <-ctx.Done():
+				return stack(ctx.Err(), "watch")
+			}
+		}
+		since = next
+	}
+}
+
+// A watcher tracks what a user is notified of, to filter the changes feed.
+type watcher struct {
+	db      *DB
+	user    string
+	circles map[string]circle   // circles of the user
+	events  map[string]struct{} // events of those circles
+	skip    map[string]struct{} // dismissed notifications
+}
+
+// load gets the circles of the user, their events and the dismissed notifications.
+func (w *watcher) load(ctx context.Context) error {
+	var vc struct{ Rows []struct{ Doc circle } }
+	if err := w.db.store.Query(ctx, ViewCircles, w.user, true, &vc); err != nil {
+		return stack(err, "error querying circles view")
+	}
+	var vd struct{ Rows []struct{ Value string } }
+	if err := w.db.store.Query(ctx, ViewDismiss, w.user, false, &vd); err != nil {
+		return stack(err, "error querying dismiss view")
+	}
+	for _, r := range vd.Rows {
+		w.skip[r.Value] = struct{}{}
+	}
+	for _, r := range vc.Rows {
+		if err := w.addCircle(ctx, r.Doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCircle tracks a circle of the user and its events.
+func (w *watcher) addCircle(ctx context.Context, c circle) error {
+	var v struct {
+		Rows []struct {
+			Value struct {
+				Event string `json:"_id"`
+			}
+		}
+	}
+	if err := w.db.store.Query(ctx, ViewEvents, c.Id, false, &v); err != nil {
+		return stack(err, "error querying events view")
+	}
+	w.circles[c.Id] = c
+	for _, r := range v.Rows {
+		w.events[r.Value.Event] = struct{}{}
+	}
+	return nil
+}
+
+// delta returns the delta caused by a change, if it concerns the user.
+func (w *watcher) delta(ctx context.Context, c Change) (Delta, bool, error) {
+	if c.Deleted {
+		return Delta{}, false, nil
+	}
+	d := Delta{Seq: c.Seq}
+	switch c.Doc["type"] {
+	case "member":
+		var m member
+		if err := fromMap(c.Doc, &m); err != nil {
+			return d, false, err
+		}
+		if _, ok := w.circles[m.Circle]; !ok && m.User == w.user {
+			var ci circle
+			if err := w.db.store.Get(ctx, m.Circle, &ci); err != nil {
+				return d, false, stack(err, "cannot get circle")
+			}
+			if err := w.addCircle(ctx, ci); err != nil {
+				return d, false, err
+			}
+		}
+		ci, ok := w.circles[m.Circle]
+		if !ok || w.skipped(m.Id) {
+			return d, false, nil
+		}
+		var u user
+		if err := w.db.store.Get(ctx, m.User, &u); err != nil {
+			return d, false, stack(err, "cannot get user")
+		}
+		d.Kind, d.Id = DeltaAdded, m.Id
+		d.Notification.Member = &Member{
+			User:   User{Id: u.Id, Name: u.Name},
+			Circle: Circle{Id: ci.Id, Name: ci.Name, Slug: ci.Slug},
+			Id:     m.Id,
+			Date:   m.Date,
+			Me:     m.User == w.user,
+		}
+
+	case "invitation":
+		var i invitation
+		if err := fromMap(c.Doc, &i); err != nil {
+			return d, false, err
+		}
+		if _, ok := w.circles[i.Circle]; !ok || w.tracked(i.Event) {
+			return d, false, nil
+		}
+		w.events[i.Event] = struct{}{}
+		if w.skipped(i.Event) {
+			return d, false, nil
+		}
+		var e event
+		if err := w.db.store.Get(ctx, i.Event, &e); err != nil {
+			return d, false, stack(err, "cannot get event")
+		}
+		d.Kind, d.Id = DeltaAdded, e.Id
+		return w.event(ctx, d, e)
+
+	case "participant":
+		var p participant
+		if err := fromMap(c.Doc, &p); err != nil {
+			return d, false, err
+		}
+		if !w.tracked(p.Event) || w.skipped(p.Event) {
+			return d, false, nil
+		}
+		var e event
+		if err := w.db.store.Get(ctx, p.Event, &e); err != nil {
+			return d, false, stack(err, "cannot get event")
+		}
+		d.Kind, d.Id = DeltaUpdated, e.Id
+		return w.event(ctx, d, e)
+
+	case "event":
+		var e event
+		if err := fromMap(c.Doc, &e); err != nil {
+			return d, false, err
+		}
+		if !w.tracked(e.Id) || w.skipped(e.Id) {
+			return d, false, nil
+		}
+		d.Kind, d.Id = DeltaUpdated, e.Id
+		return w.event(ctx, d, e)
+
+	case "dismiss":
+		var x dismiss
+		if err := fromMap(c.Doc, &x); err != nil {
+			return d, false, err
+		}
+		if x.User != w.user || w.skipped(x.What) {
+			return d, false, nil
+		}
+		w.skip[x.What] = struct{}{}
+		d.Kind, d.Id = DeltaDismissed, x.What
+
+	default:
+		return d, false, nil
+	}
+	return d, true, nil
+}
+
+// event completes a delta with the notification of an event.
+func (w *watcher) event(ctx context.Context, d Delta, e event) (Delta, bool, error) {
+	ev, err := w.db.eventNotification(ctx, e)
+	if err != nil {
+		return d, false, err
+	}
+	d.Notification.Event = ev
+	return d, true, nil
+}
+
+// tracked reports whether an event was posted to a circle of the user.
+func (w *watcher) tracked(event string) bool {
+	_, ok := w.events[event]
+	return ok
+}
+
+// skipped reports whether the user dismissed a notification.
+func (w *watcher) skipped(id string) bool {
+	_, ok := w.skip[id]
+	return ok
+}
+
+// fromMap decodes a document in its generic JSON form into v.
+func fromMap(d map[string]interface{}, v interface{}) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return stack(err, "error encoding document")
+	}
+	return stack(json.Unmarshal(b, v), "error decoding document")
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// watch runs Watch in the background from the since sequence.
+// It returns the channel of the deltas and a function stopping Watch and checking it was not failing.
+func watch(t *testing.T, db *DB, userId, since string) (<-chan Delta, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan Delta, 10)
+	done := make(chan error, 1)
+	go func() { done <- db.Watch(ctx, userId, since, ch) }()
+	return ch, func() {
+		t.Helper()
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("watch: got %v, want context.Canceled", err)
+		}
+	}
+}
+
+// nextDelta returns the next delta sent by Watch.
+func nextDelta(t *testing.T, ch <-chan Delta) Delta {
+	t.Helper()
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no delta")
+	}
+	return Delta{}
+}
+
+// now returns the sequence of the last change of a Memory store.
+func now(t *testing.T, m *Memory) string {
+	t.Helper()
+	_, seq, err := m.Changes(context.Background(), "now", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seq
+}
+
+func TestWatchResume(t *testing.T) {
+	db, m := fixtureDB(t)
+	ch, stop := watch(t, db, "u0sim", now(t, m))
+	if err := db.JoinEvent("e0swim", "u0kus"); err != nil {
+		t.Fatal(err)
+	}
+	joined := nextDelta(t, ch)
+	if joined.Kind != DeltaUpdated || joined.Id != "e0swim" || len(joined.Notification.Event.Participants) != 2 {
+		t.Fatalf("got %v delta of %q, want e0swim updated with 2 participants", joined.Kind, joined.Id)
+	}
+	if err := db.JoinEvent("e0movie", "u0kus"); err != nil {
+		t.Fatal(err)
+	}
+	if d := nextDelta(t, ch); d.Kind != DeltaUpdated || d.Id != "e0movie" {
+		t.Fatalf("got %v delta of %q, want e0movie updated", d.Kind, d.Id)
+	}
+	stop()
+
+	// Resuming after the first join only sends what followed it
+	ch, stop = watch(t, db, "u0sim", joined.Seq)
+	defer stop()
+	if d := nextDelta(t, ch); d.Kind != DeltaUpdated || d.Id != "e0movie" || len(d.Notification.Event.Participants) != 4 {
+		t.Fatalf("got %v delta of %q after resuming, want e0movie updated with 4 participants", d.Kind, d.Id)
+	}
+	if err := db.DismissFeedEntry("e0frisbee", "u0sim"); err != nil {
+		t.Fatal(err)
+	}
+	if d := nextDelta(t, ch); d.Kind != DeltaDismissed || d.Id != "e0frisbee" {
+		t.Errorf("got %v delta of %q, want e0frisbee dismissed", d.Kind, d.Id)
+	}
+}
+
+func TestWatchDeletedEvent(t *testing.T) {
+	_, m := fixtureDB(t)
+	var logs bytes.Buffer
+	db := NewWithStore(m, WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	since := now(t, m)
+	ch, stop := watch(t, db, "u0sim", since)
+
+	// The invitation and participant of an event that no longer exists, as left by a failed rollback
+	ctx := context.Background()
+	if _, _, err := m.Create(ctx, invitation{Type: "invitation", Circle: "c0kus", Event: "e0gone"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.Create(ctx, participant{Type: "participant", User: "u0kus", Event: "e0gone", Date: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.JoinEvent("e0movie", "u0kus"); err != nil {
+		t.Fatal(err)
+	}
+	if d := nextDelta(t, ch); d.Kind != DeltaUpdated || d.Id != "e0movie" {
+		t.Errorf("got %v delta of %q, want e0movie updated", d.Kind, d.Id)
+	}
+	stop()
+	if !strings.Contains(logs.String(), "watch: skipping change") {
+		t.Errorf("skipped changes not logged: %q", logs.String())
+	}
+
+	// Resuming before them skips them again rather than failing
+	ch, stop = watch(t, db, "u0sim", since)
+	defer stop()
+	if d := nextDelta(t, ch); d.Kind != DeltaUpdated || d.Id != "e0movie" {
+		t.Errorf("got %v delta of %q after resuming, want e0movie updated", d.Kind, d.Id)
+	}
+}